@@ -0,0 +1,95 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements systemd-style socket activation.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the first file descriptor passed by socket activation
+const listenFdsStart = 3
+
+var (
+	// activated listeners, their names, and any error from
+	// finding them. they are looked up once.
+	sdOnce  sync.Once
+	sdLs    []net.Listener
+	sdNames []string
+	sdErr   error
+)
+
+// SystemdListeners returns the listener sockets passed to this
+// process by socket activation, following the systemd convention:
+// LISTEN_PID holds the pid of the process the sockets are meant
+// for, LISTEN_FDS the number of sockets (starting at file descriptor
+// 3), and LISTEN_FDNAMES an optional colon-separated list of their
+// names. Sockets without names are called "unknown". If no sockets
+// were passed, both slices are empty.
+//
+// The environment is read only once, so SystemdListeners returns
+// the same Listeners every time it is called.
+func SystemdListeners() ([]net.Listener, []string, error) {
+	sdOnce.Do(func() {
+		sdLs, sdNames, sdErr = systemdListeners()
+	})
+	return sdLs, sdNames, sdErr
+}
+
+// systemdListeners does the work of SystemdListeners.
+func systemdListeners() ([]net.Listener, []string, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		// the sockets, if any, aren't ours
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	ls := make([]net.Listener, n)
+	ns := make([]string, n)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		ns[i] = "unknown"
+		if i < len(names) && names[i] != "" {
+			ns[i] = names[i]
+		}
+		f := os.NewFile(uintptr(fd), ns[i])
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("activated socket %d (%s): %v", fd, ns[i], err)
+		}
+		ls[i] = l
+	}
+	return ls, ns, nil
+}
+
+// SystemdServer returns a Server which listens on the socket-activated
+// socket called 'name' (see SystemdListeners), or on the first one if
+// name is "". To use TLS, or more than one socket, get the Listeners
+// from SystemdListeners and pass them to NewServer.
+func SystemdServer(c *ServerConfig, name string) (*Server, error) {
+	ls, ns, err := SystemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range ls {
+		if name == "" || ns[i] == name {
+			return NewServer(c, l)
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no sockets passed by socket activation")
+	}
+	return nil, fmt.Errorf("no socket named '%s' passed by socket activation", name)
+}
@@ -7,24 +7,69 @@ package petrel
 // This file implements the Petrel client.
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"math/rand"
 	"net"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Client is a Petrel client instance.
+// Client is a Petrel client instance. A Client is safe for
+// concurrent use by multiple goroutines; each caller blocks only
+// until its own response arrives.
 type Client struct {
 	conn net.Conn
+	// dials a new conn, for reconnection
+	dial func() (net.Conn, error)
+	// reconnect policy
+	rp *ReconnectPolicy
+	// lock serializing reconnects
+	rm sync.Mutex
 	// timeout length
 	to time.Duration
-	// HMAC key
-	hk []byte
+	// conn's sealer, if transmissions are authenticated or
+	// encrypted, and the func which sets one up for new conns
+	sl sealer
+	ns newSealer
 	// conn closed semaphore
 	cc bool
-	// transmission sequence id
+	// Quit called semaphore
+	qc bool
+	// transmission sequence id. it must only be modified
+	// atomically
 	Seq uint32
+	// lock for pend and cc
+	m sync.Mutex
+	// lock for writes to conn
+	wm sync.Mutex
+	// Calls awaiting responses, by sequence id
+	pend map[uint32]*Call
+	// Dispatch, with Interceptors applied
+	di func([]byte) ([]byte, error)
+}
+
+// Call is a request which has been sent by a Client, and which may or
+// may not have received a response.
+type Call struct {
+	// Seq is the sequence id of the request.
+	Seq uint32
+	// Resp is the response to the request.
+	Resp []byte
+	// Err is the error (if any) resulting from the request.
+	Err error
+	// Done receives the Call when it is complete.
+	Done chan *Call
+	// raw is true for Calls made via DispatchRaw
+	raw bool
+	// the conn the Call was sent on
+	conn net.Conn
+	// timeout timer
+	t *time.Timer
 }
 
 // ClientConfig holds values to be passed to the client constructor.
@@ -44,105 +89,492 @@ type ClientConfig struct {
 	//generated for messages sent, or expected for messages
 	//received.
 	HMACKey []byte
+
+	// Keyring holds HMAC keys, identified by number, which are
+	// used instead of HMACKey. Requests are signed with its
+	// signing key, and responses signed with any key in it are
+	// accepted (see Keyring).
+	Keyring *Keyring
+
+	// ReplayWindow turns on replay protection, as described for
+	// ServerConfig. The Client refuses responses which are
+	// replayed, or which are more than ReplayWindow milliseconds
+	// away from its clock. Default (zero) is off.
+	ReplayWindow int64
+
+	// SignKey and ServerKey turn on Ed25519 message signing, in
+	// place of HMAC (see ServerConfig.SignKey). Requests are
+	// signed with SignKey, whose public half must be one of the
+	// Server's ClientKeys, and responses must be signed by the
+	// private half of ServerKey.
+	SignKey   ed25519.PrivateKey
+	ServerKey ed25519.PublicKey
+
+	// PSK is a pre-shared secret which turns on encryption (see
+	// ServerConfig.PSK). It must match the Server's. Clients
+	// using a PSK can't use DispatchRaw.
+	PSK []byte
+
+	// Reconnect is the policy for re-establishing connections
+	// which have been closed by network or protocol errors. The
+	// default (nil) is no reconnection: once its connection is
+	// closed, a Client is permanently unusable.
+	Reconnect *ReconnectPolicy
+
+	// Interceptors are wrapped around Dispatch, in order (the
+	// first is outermost).
+	Interceptors []ClientInterceptor
 }
 
+// ClientInterceptor is a function which wraps Client.Dispatch. It
+// receives the request and 'next', which continues the chain toward
+// the network. Like a server-side Interceptor, it may alter the
+// request or response, return early, or time the call.
+type ClientInterceptor func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error)
+
+// ReconnectPolicy controls automatic reconnection. When a Client
+// with a ReconnectPolicy finds its connection closed, the next
+// request re-dials the Server using the same network as the
+// original constructor, retrying with exponential backoff. Requests
+// which could not be written to the network are retried once on the
+// new connection; requests which were sent, but whose responses were
+// lost, are not retried since the Server may already have acted on
+// them.
+type ReconnectPolicy struct {
+	// Attempts is the maximum number of dials per reconnection
+	// before giving up and returning an error. Default (zero) is
+	// unlimited.
+	Attempts int
+
+	// Base is the number of milliseconds to wait after the first
+	// failed attempt. The wait doubles after each subsequent
+	// failure. Defaults to 100.
+	Base int64
+
+	// Max is the longest wait, in milliseconds, between
+	// attempts. Defaults to 10000.
+	Max int64
+
+	// Jitter, between 0 and 1, is the fraction of each wait which
+	// is randomized, to keep many Clients from reconnecting in
+	// lockstep. Default is zero.
+	Jitter float64
+
+	// Notify, if not nil, is called after each reconnection
+	// attempt with the attempt number and the result of the dial
+	// (nil on success).
+	Notify func(attempt int, err error)
+}
+
+// backoff returns the time to wait after failed attempt n.
+func (rp *ReconnectPolicy) backoff(n int) time.Duration {
+	base, max := rp.Base, rp.Max
+	if base <= 0 {
+		base = 100
+	}
+	if max <= 0 {
+		max = 10000
+	}
+	d := time.Duration(base) * time.Millisecond
+	for i := 1; i < n && d < time.Duration(max)*time.Millisecond; i++ {
+		d *= 2
+	}
+	if m := time.Duration(max) * time.Millisecond; d > m {
+		d = m
+	}
+	if rp.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * rp.Jitter * float64(d))
+	}
+	return d
+}
+
+// timeoutErr is the error given to Calls which do not receive a
+// response within the Client's timeout.
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "no response received: i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
 // TCPClient returns a Client which uses TCP.
 func TCPClient(c *ClientConfig) (*Client, error) {
-	conn, err := net.Dial("tcp", c.Addr)
-	if err != nil {
-		return nil, err
-	}
-	return newCommon(c, conn)
+	return newCommon(c, func() (net.Conn, error) { return net.Dial("tcp", c.Addr) })
 }
 
 // TLSClient returns a Client which uses TLS + TCP.
 func TLSClient(c *ClientConfig, t *tls.Config) (*Client, error) {
-	conn, err := tls.Dial("tcp", c.Addr, t)
-	if err != nil {
+	return newCommon(c, func() (net.Conn, error) { return tls.Dial("tcp", c.Addr, t) })
+}
+
+// UnixClient returns a Client which uses Unix domain sockets. On
+// Linux, addresses starting with "@" are in the abstract namespace.
+func UnixClient(c *ClientConfig) (*Client, error) {
+	if err := abstractCheck(c.Addr); err != nil {
 		return nil, err
 	}
-	return newCommon(c, conn)
+	return newCommon(c, func() (net.Conn, error) { return net.Dial("unix", c.Addr) })
 }
 
-// UnixClient returns a Client which uses Unix domain sockets.
-func UnixClient(c *ClientConfig) (*Client, error) {
-	conn, err := net.Dial("unix", c.Addr)
+func newCommon(c *ClientConfig, dial func() (net.Conn, error)) (*Client, error) {
+	if err := c.keyCheck(); err != nil {
+		return nil, err
+	}
+	cl := &Client{
+		dial: dial,
+		rp:   c.Reconnect,
+		to:   time.Duration(c.Timeout) * time.Millisecond,
+		ns:   c.sealers(),
+		pend: make(map[uint32]*Call),
+	}
+	conn, sl, err := cl.connect()
 	if err != nil {
 		return nil, err
 	}
-	return newCommon(c, conn)
+	cl.conn, cl.sl = conn, sl
+	cl.di = cl.dispatch
+	for i := len(c.Interceptors) - 1; i >= 0; i-- {
+		f, next := c.Interceptors[i], cl.di
+		cl.di = func(req []byte) ([]byte, error) { return f(req, next) }
+	}
+	go cl.reader(conn, sl)
+	return cl, nil
+}
+
+// connect dials the Server, and sets up the new connection's sealer.
+func (c *Client) connect() (net.Conn, sealer, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	sl, err := c.ns(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, sl, nil
 }
 
-func newCommon(c *ClientConfig, conn net.Conn) (*Client, error) {
-	return &Client{conn, time.Duration(c.Timeout) * time.Millisecond, c.HMACKey, false, 0}, nil
+// sealers returns the function which sets up the sealer for each of
+// a Client's connections.
+func (c *ClientConfig) sealers() newSealer {
+	if c.PSK != nil {
+		psk, to := c.PSK, time.Duration(c.Timeout)*time.Millisecond
+		return func(conn net.Conn) (sealer, error) { return pskConnect(conn, psk, to) }
+	}
+	sl := c.sealer()
+	return func(net.Conn) (sealer, error) { return sl, nil }
+}
+
+// sealer returns the sealer for a Client which doesn't need a
+// handshake.
+func (c *ClientConfig) sealer() sealer {
+	var mk macKeys
+	switch {
+	case c.SignKey != nil:
+		return newSigSealer(c.SignKey, c.ServerKey)
+	case c.Keyring != nil:
+		mk = &ringSealer{kr: c.Keyring}
+	case c.HMACKey != nil:
+		mk = hmacSealer(c.HMACKey)
+	default:
+		return nil
+	}
+	if c.ReplayWindow > 0 {
+		return &replaySealer{mk, newNonceCache(c.ReplayWindow)}
+	}
+	return mk
 }
 
 // Dispatch sends a request and returns the response.
 func (c *Client) Dispatch(req []byte) ([]byte, error) {
-	c.Seq++
-	// if a previous error closed the conn, refuse to do anything
-	if c.cc == true {
-		return nil, fmt.Errorf("the network connection is closed due to a previous error; please create a new Client")
+	return c.di(req)
+}
+
+// dispatch is Dispatch, minus Interceptors.
+func (c *Client) dispatch(req []byte) ([]byte, error) {
+	call := <-c.Go(req).Done
+	return call.Resp, call.Err
+}
+
+// Go sends a request and returns without waiting for the
+// response. The returned Call's Done channel will receive the Call
+// when the response arrives (or the request fails). Responses are
+// matched to their Calls by sequence id, so any number of Calls may
+// be outstanding at once; if the Server is configured to allow it,
+// they will be handled concurrently.
+func (c *Client) Go(req []byte) *Call {
+	call := &Call{Seq: c.nextSeq(), Done: make(chan *Call, 1)}
+	for retry := c.rp != nil; ; retry = false {
+		conn, sl := c.send(call)
+		if conn == nil {
+			return call
+		}
+		c.wm.Lock()
+		_, err := connWrite(conn, req, sl, c.to, call.Seq)
+		c.wm.Unlock()
+		if err == nil {
+			return call
+		}
+		// the request never made it out, so if we can
+		// reconnect it is safe to try again
+		if retry && c.unsend(call.Seq, conn) {
+			continue
+		}
+		c.finish(call.Seq, nil, nil, err)
+		return call
 	}
-	_, err := connWrite(c.conn, req, c.hk, c.to, c.Seq)
-	if err != nil {
-		return nil, err
+}
+
+// nextSeq returns the next sequence id. Zero is skipped, as it is
+// reserved for notices from the Server which are not responses to
+// any request.
+func (c *Client) nextSeq() uint32 {
+	for {
+		if seq := atomic.AddUint32(&c.Seq, 1); seq != 0 {
+			return seq
+		}
 	}
-	resp, err := c.read(false)
-	return resp, err
 }
 
 // DispatchRaw sends a pre-encoded transmission and returns the
-// response.
+// response, also as a complete transmission. It can't be used by
+// Clients with a PSK, since their transmissions must be encrypted in
+// order.
 func (c *Client) DispatchRaw(xmission []byte) ([]byte, error) {
+	call := &Call{Done: make(chan *Call, 1), raw: true}
+	if len(xmission) < 4 {
+		return nil, fmt.Errorf("transmission too short")
+	}
+	if _, ok := c.sealer().(*aeadSealer); ok {
+		return nil, fmt.Errorf("DispatchRaw can't be used with encryption")
+	}
+	binary.Read(bytes.NewReader(xmission[0:4]), binary.LittleEndian, &call.Seq)
+	conn, _ := c.send(call)
+	if conn == nil {
+		return nil, call.Err
+	}
+	c.wm.Lock()
+	_, err := connWriteRaw(conn, c.to, xmission)
+	c.wm.Unlock()
+	if err != nil {
+		c.finish(call.Seq, nil, nil, err)
+	}
+	<-call.Done
+	return call.Resp, call.Err
+}
+
+// send registers a Call as pending, reconnecting first if need be,
+// and returns the conn the request should be written to, with its
+// sealer. It returns nil (and completes the Call) if that isn't
+// possible.
+func (c *Client) send(call *Call) (net.Conn, sealer) {
+	c.m.Lock()
+	if c.cc && !c.qc && c.rp != nil {
+		c.m.Unlock()
+		if err := c.reconnect(); err != nil {
+			call.Err = err
+			call.Done <- call
+			return nil, nil
+		}
+		c.m.Lock()
+	}
+	defer c.m.Unlock()
 	// if a previous error closed the conn, refuse to do anything
 	if c.cc == true {
-		return nil, fmt.Errorf("the network connection is closed due to a previous error; please create a new Client")
+		call.Err = fmt.Errorf("the network connection is closed due to a previous error; please create a new Client")
+		call.Done <- call
+		return nil, nil
 	}
-	_, err := connWriteRaw(c.conn, c.to, xmission)
-	if err != nil {
-		return nil, err
+	if _, ok := c.pend[call.Seq]; ok {
+		call.Err = fmt.Errorf("sequence id %d is already in flight", call.Seq)
+		call.Done <- call
+		return nil, nil
 	}
-	resp, err := c.read(true)
-	return resp, err
+	call.conn = c.conn
+	c.pend[call.Seq] = call
+	if c.to > 0 {
+		seq := call.Seq
+		call.t = time.AfterFunc(c.to, func() { c.finish(seq, nil, nil, timeoutErr{}) })
+	}
+	return c.conn, c.sl
 }
 
-// read reads from the network.
-func (c *Client) read(raw bool) ([]byte, error) {
-	var resp []byte
-	var perr string
-	var err error
-	if raw {
-		resp, perr, _, err = connReadRaw(c.conn, c.to)
-	} else {
-		resp, perr, _, err = connRead(c.conn, c.to, 0, c.hk, &c.Seq)
+// unsend removes a Call which could not be written from the pending
+// set, and marks its conn as dead so that the next send will
+// reconnect. It returns false if the Call has already been completed
+// by someone else.
+func (c *Client) unsend(seq uint32, conn net.Conn) bool {
+	c.m.Lock()
+	call, ok := c.pend[seq]
+	delete(c.pend, seq)
+	if c.conn == conn {
+		c.cc = true
 	}
-	if err != nil {
-		return nil, err
+	c.m.Unlock()
+	conn.Close()
+	if ok && call.t != nil {
+		call.t.Stop()
 	}
-	if perr != "" {
-		return nil, perrs[perr]
+	return ok
+}
+
+// reconnect dials a new connection for the Client, according to its
+// ReconnectPolicy.
+func (c *Client) reconnect() error {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	// someone else may have gotten here first
+	c.m.Lock()
+	done := !c.cc || c.qc
+	c.m.Unlock()
+	if done {
+		return nil
 	}
-	// check for/handle remote-side error responses
-	if len(resp) == 11 && resp[0] == 80 { // 11 bytes, starting with 'P'
-		pp := string(resp[0:8])
-		if pp == "PERRPERR" {
-			code, err := strconv.Atoi(string(resp[8:11]))
-			if code == 402 || code == 502 {
-				c.Quit()
+	for n := 1; ; n++ {
+		conn, sl, err := c.connect()
+		if c.rp.Notify != nil {
+			c.rp.Notify(n, err)
+		}
+		if err == nil {
+			c.m.Lock()
+			if c.qc {
+				// Quit was called while we were dialing
+				c.m.Unlock()
+				conn.Close()
+				return nil
 			}
-			if err != nil {
-				return []byte{255}, fmt.Errorf("request error: unknown code %d", code)
+			c.conn, c.sl = conn, sl
+			c.cc = false
+			c.m.Unlock()
+			go c.reader(conn, sl)
+			return nil
+		}
+		if c.rp.Attempts > 0 && n >= c.rp.Attempts {
+			return fmt.Errorf("reconnect failed after %d attempts: %s", n, err)
+		}
+		time.Sleep(c.rp.backoff(n))
+	}
+}
+
+// finish completes the pending Call with sequence id seq, if there
+// is one. Whichever of the reader, the timeout timer, or a failed
+// write gets here first wins; later attempts are no-ops. hdr is the
+// header resp arrived with, which DispatchRaw hands back along with
+// it.
+func (c *Client) finish(seq uint32, hdr, resp []byte, err error) {
+	c.m.Lock()
+	call, ok := c.pend[seq]
+	delete(c.pend, seq)
+	c.m.Unlock()
+	if !ok {
+		return
+	}
+	if call.t != nil {
+		call.t.Stop()
+	}
+	if err == nil && call.raw {
+		resp = append(hdr, resp...)
+	} else if err == nil {
+		resp, err = c.unpack(resp, call.conn)
+	}
+	call.Resp = resp
+	call.Err = err
+	call.Done <- call
+}
+
+// reader runs for the life of a connection, reading responses and
+// handing them off to the Calls waiting on them.
+func (c *Client) reader(conn net.Conn, sl sealer) {
+	var seq uint32
+	var hdr []byte
+	for {
+		resp, perr, _, err := connRead(conn, 0, 0, sl, &seq, nil, &hdr)
+		if err == nil && perr != "" {
+			err = perrs[perr]
+		}
+		if err == nil && seq == 0 {
+			// a notice from the Server, which is about
+			// to close the connection
+			if p := unframe(resp); p != nil {
+				err = p
+			}
+		}
+		if err != nil {
+			// the connection is unusable. mark it
+			// closed and fail everything in flight on it
+			c.m.Lock()
+			if c.conn == conn {
+				c.cc = true
 			}
-			return []byte{255}, perrs[perrmap[code]]
+			pend := []*Call{}
+			for seq, call := range c.pend {
+				if call.conn == conn {
+					pend = append(pend, call)
+					delete(c.pend, seq)
+				}
+			}
+			c.m.Unlock()
+			conn.Close()
+			for _, call := range pend {
+				if call.t != nil {
+					call.t.Stop()
+				}
+				call.Err = err
+				call.Done <- call
+			}
+			return
+		}
+		c.finish(seq, hdr, resp, nil)
+	}
+}
+
+// unpack checks for and handles remote-side error responses, which
+// arrived on 'conn'.
+func (c *Client) unpack(resp []byte, conn net.Conn) ([]byte, error) {
+	p := unframe(resp)
+	if p == nil {
+		return resp, nil
+	}
+	if p.Code == 402 || p.Code == 406 || p.Code == 502 {
+		// the Server has closed the connection. if we've
+		// already reconnected, the new one is fine
+		c.m.Lock()
+		if c.conn == conn {
+			c.cc = true
 		}
+		c.m.Unlock()
+		conn.Close()
 	}
-	return resp, err
+	if p.Code == 429 {
+		return []byte{255}, &RateLimitErr{retryAfter(p.Msg)}
+	}
+	if p.Code >= AppCodeMin && p.Code <= AppCodeMax {
+		return []byte{255}, &AppErr{Code: p.Code, Txt: p.Msg}
+	}
+	return []byte{255}, p
+}
+
+// sealer returns the sealer of the Client's connection.
+func (c *Client) sealer() sealer {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.sl
+}
+
+// closed reports whether the Client's connection has been closed.
+func (c *Client) closed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cc
 }
 
 // Quit terminates the client's network connection and other
 // operations.
 func (c *Client) Quit() {
+	c.m.Lock()
 	c.cc = true
-	c.conn.Close()
+	c.qc = true
+	conn := c.conn
+	c.m.Unlock()
+	conn.Close()
 }
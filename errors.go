@@ -5,7 +5,10 @@ package petrel
 // BSD-style license that can be found in the LICENSE file.
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 // Message levels control which messages will be sent to h.Msgr
@@ -16,107 +19,248 @@ const (
 	Fatal
 )
 
+// The range of status codes reserved for applications. See AppErr.
+const (
+	AppCodeMin = 1000
+	AppCodeMax = 9999
+)
+
 var (
 	perrs = map[string]*Perr{
 		"connect": {
-			100,
-			Conn,
-			"client connected",
-			nil},
+			Code: 100,
+			Lvl:  Conn,
+			Txt:  "client connected"},
 		"dispatch": {
-			101,
-			All,
-			"dispatching",
-			nil},
+			Code: 101,
+			Lvl:  All,
+			Txt:  "dispatching"},
+		"goodbye": {
+			Code: 195,
+			Lvl:  Conn,
+			Txt:  "server shutting down",
+			xmit: []byte("PERRPERR195")},
 		"netreaderr": {
-			196,
-			Conn,
-			"network read error",
-			nil},
+			Code: 196,
+			Lvl:  Conn,
+			Txt:  "network read error"},
 		"netwriteerr": {
-			197,
-			Conn,
-			"network write error",
-			nil},
+			Code: 197,
+			Lvl:  Conn,
+			Txt:  "network write error"},
 		"disconnect": {
-			198,
-			Conn,
-			"client disconnected",
-			nil},
+			Code: 198,
+			Lvl:  Conn,
+			Txt:  "client disconnected"},
 		"quit": {
-			199,
-			All,
-			"Quit called: closing listener socket",
-			nil},
+			Code: 199,
+			Lvl:  All,
+			Txt:  "Quit called: closing listener socket"},
 		"success": {
-			200,
-			All,
-			"reply sent",
-			nil},
+			Code: 200,
+			Lvl:  All,
+			Txt:  "reply sent"},
 		"badreq": {
-			400,
-			All,
-			"bad command",
-			[]byte("PERRPERR400")},
+			Code: 400,
+			Lvl:  All,
+			Txt:  "bad command",
+			xmit: []byte("PERRPERR400")},
 		"nilreq": {
-			401,
-			All,
-			"nil request",
-			[]byte("PERRPERR401")},
+			Code: 401,
+			Lvl:  All,
+			Txt:  "nil request",
+			xmit: []byte("PERRPERR401")},
 		"plenex": {
-			402,
-			Error,
-			"payload size limit exceeded; closing conn",
-			[]byte("PERRPERR402")},
+			Code: 402,
+			Lvl:  Error,
+			Txt:  "payload size limit exceeded; closing conn",
+			xmit: []byte("PERRPERR402")},
+		"refused": {
+			Code: 403,
+			Lvl:  Conn,
+			Txt:  "connection refused",
+			xmit: []byte("PERRPERR403")},
+		"badpeer": {
+			Code: 405,
+			Lvl:  Conn,
+			Txt:  "peer credentials rejected",
+			xmit: []byte("PERRPERR405")},
+		"replay": {
+			Code: 406,
+			Lvl:  Error,
+			Txt:  "replayed or stale transmission; closing conn",
+			xmit: []byte("PERRPERR406")},
+		"ratelimit": {
+			Code: 429,
+			Lvl:  Error,
+			Txt:  "rate limited",
+			xmit: []byte("PERRPERR429")},
 		"reqerr": {
-			500,
-			Error,
-			"request failed",
-			[]byte("PERRPERR500")},
+			Code: 500,
+			Lvl:  Error,
+			Txt:  "request failed",
+			xmit: []byte("PERRPERR500")},
 		"internalerr": {
-			501,
-			Error,
-			"internal error",
-			nil},
+			Code: 501,
+			Lvl:  Error,
+			Txt:  "internal error"},
 		"badmac": {
-			502,
-			Error,
-			"HMAC verification failed; closing conn",
-			[]byte("PERRPERR502")},
+			Code: 502,
+			Lvl:  Error,
+			Txt:  "HMAC verification failed; closing conn",
+			xmit: []byte("PERRPERR502")},
+		"busy": {
+			Code: 503,
+			Lvl:  Error,
+			Txt:  "server busy",
+			xmit: []byte("PERRPERR503")},
+		"reqtimeout": {
+			Code: 504,
+			Lvl:  Error,
+			Txt:  "request timed out",
+			xmit: []byte("PERRPERR504")},
+		"reqpanic": {
+			Code: 505,
+			Lvl:  Error,
+			Txt:  "responder panicked",
+			xmit: []byte("PERRPERR505")},
 		"listenerfail": {
-			599,
-			Fatal,
-			"read from listener socket failed",
-			nil},
+			Code: 599,
+			Lvl:  Fatal,
+			Txt:  "read from listener socket failed"},
 	}
-	perrmap = map[int]string{
-		100: "connect",
-		101: "dispatch",
-		196: "netreaderr",
-		197: "netwriteerr",
-		198: "disconnect",
-		199: "quit",
-		200: "success",
-		400: "badreq",
-		401: "nilreq",
-		402: "plenex",
-		403: "badmac",
-		500: "reqerr",
-		501: "internalerr",
-		599: "listenerfail"}
+	// perrmap maps status codes back to perrs keys. It is built
+	// from perrs at init.
+	perrmap = map[int]string{}
 )
 
+func init() {
+	for k, p := range perrs {
+		perrmap[p.Code] = k
+	}
+}
+
 // Perr is a Petrel error -- though perhaps a better name would have
 // been Pstatus. The data which is used to generate internal and
 // external informational and error messages are stored as Perrs.
+//
+// When a Server sends an error response, the Client returns a Perr
+// with Kind and Msg filled in from the error frame.
 type Perr struct {
 	Code int
 	Lvl  int
 	Txt  string
+	// Kind is the machine-readable name of the status (e.g.
+	// "reqerr", "badreq").
+	Kind string
+	// Msg is the error text, if any, which accompanied the
+	// status. For "reqerr", this is the text of the error
+	// returned by the Responder.
+	Msg  string
 	xmit []byte
 }
 
 // Error implements the error interface for Perr.
 func (p Perr) Error() string {
+	if p.Msg != "" {
+		return fmt.Sprintf("%s (%d): %s", p.Txt, p.Code, p.Msg)
+	}
 	return fmt.Sprintf("%s (%d)", p.Txt, p.Code)
 }
+
+// frame returns the error frame sent to clients for this Perr. The
+// format is "PERRPERR", the status code, and then -- NUL-separated --
+// the kind and message. (Earlier versions of Petrel sent only the
+// first 11 bytes, which is why Proto was bumped along with this
+// format.)
+func (p *Perr) frame(kind, msg string) []byte {
+	f := append([]byte{}, p.xmit...)
+	f = append(f, 0)
+	f = append(f, kind...)
+	f = append(f, 0)
+	return append(f, msg...)
+}
+
+// unframe decodes an error frame, returning nil if resp is not one.
+func unframe(resp []byte) *Perr {
+	if len(resp) < 11 || string(resp[0:8]) != "PERRPERR" {
+		return nil
+	}
+	cb := resp[8:]
+	i := bytes.IndexByte(cb, 0)
+	if i == -1 {
+		return nil
+	}
+	var msg string
+	km := bytes.SplitN(cb[i+1:], []byte{0}, 2)
+	kind := string(km[0])
+	if len(km) == 2 {
+		msg = string(km[1])
+	}
+	cb = cb[:i]
+	code, err := strconv.Atoi(string(cb))
+	if err != nil {
+		return nil
+	}
+	if kind == "" {
+		kind = perrmap[code]
+	}
+	p := &Perr{Code: code, Lvl: Error, Txt: "unknown error", Kind: kind, Msg: msg}
+	if sp, ok := perrs[perrmap[code]]; ok {
+		p.Lvl = sp.Lvl
+		p.Txt = sp.Txt
+	}
+	return p
+}
+
+// AppErr is an error with an application-defined status code. When
+// a Responder returns an AppErr (or an error wrapping one) whose Code
+// is between AppCodeMin and AppCodeMax, the Server sends the code
+// and text to the client, and the Client returns a matching AppErr
+// from Dispatch. AppErrs are never redacted. An AppErr with a code
+// outside the reserved range is treated like any other error.
+type AppErr struct {
+	Code int
+	Txt  string
+}
+
+// Error implements the error interface for AppErr.
+func (e *AppErr) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Txt, e.Code)
+}
+
+// valid reports whether the AppErr's code is in the reserved range.
+func (e *AppErr) valid() bool {
+	return e.Code >= AppCodeMin && e.Code <= AppCodeMax
+}
+
+// perr returns a Perr which can be used to report the AppErr via
+// Msgr and to build its error frame.
+func (e *AppErr) perr() *Perr {
+	return &Perr{
+		Code: e.Code,
+		Lvl:  All,
+		Txt:  "application error",
+		xmit: []byte(fmt.Sprintf("PERRPERR%d", e.Code)),
+	}
+}
+
+// RateLimitErr is returned by Client when a request has been refused
+// because the client exceeded one of the Server's rate limits.
+type RateLimitErr struct {
+	// RetryAfter is how long the Server suggests waiting before
+	// sending another request.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface for RateLimitErr.
+func (e *RateLimitErr) Error() string {
+	return fmt.Sprintf("rate limited; retry after %v", e.RetryAfter)
+}
+
+// retryAfter extracts the retry-after hint from the message of a
+// rate limit error frame, which is a number of milliseconds.
+func retryAfter(msg string) time.Duration {
+	ms, _ := strconv.ParseInt(msg, 10, 64)
+	return time.Duration(ms) * time.Millisecond
+}
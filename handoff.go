@@ -0,0 +1,90 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements listener handoff, for restarting a Server
+// without dropping connections.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// HandoffEnv is the environment variable which tells a process
+// started by Server.Handoff which file descriptor holds its
+// listener.
+const HandoffEnv = "PETREL_LISTEN_FD"
+
+// ListenerFile returns a duplicate of the file descriptor of the
+// Server's listener socket, which can be passed to another process
+// and turned back into a Server with FileServer or TLSFileServer.
+// Closing the Server does not close the duplicate, so the socket
+// stays open (and, for Unix sockets, the socket file stays in place)
+// as long as the other process has it.
+//
+// Only a Server with a single listener can be handed off; if others
+// have been added with AddListener, ListenerFile returns an error.
+func (s *Server) ListenerFile() (*os.File, error) {
+	s.cm.Lock()
+	n := len(s.ls)
+	s.cm.Unlock()
+	if n > 1 {
+		return nil, fmt.Errorf("server has %d listeners, and only one can be handed off", n)
+	}
+	switch l := s.nl.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		// the socket file belongs to whoever gets the fd now
+		l.SetUnlinkOnClose(false)
+		s.cm.Lock()
+		s.us = nil
+		s.cm.Unlock()
+		return l.File()
+	}
+	return nil, fmt.Errorf("listener type %T cannot be handed off", s.nl)
+}
+
+// Handoff starts cmd -- typically a new copy of the program -- with
+// the Server's listener socket as an extra file, and HandoffEnv set
+// in its environment so that it can find it with HandoffFile. Both
+// processes accept connections on the socket until this one stops;
+// call Shutdown after Handoff to drain this process without
+// refusing any clients. As with ListenerFile, the Server must have
+// only one listener.
+func (s *Server) Handoff(cmd *exec.Cmd) error {
+	f, err := s.ListenerFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	// ExtraFiles start after stdin, stdout, and stderr
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", HandoffEnv, 2+len(cmd.ExtraFiles)))
+	return cmd.Start()
+}
+
+// HandoffFile returns the listener socket passed to this process by
+// Server.Handoff, for use with FileServer or TLSFileServer. It
+// returns nil if there isn't one. HandoffEnv is cleared, so that the
+// socket is not claimed twice.
+func HandoffFile() (*os.File, error) {
+	v := os.Getenv(HandoffEnv)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(HandoffEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("bad value for %s: '%s'", HandoffEnv, v)
+	}
+	return os.NewFile(uintptr(fd), "petrel-listener"), nil
+}
@@ -0,0 +1,273 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements HMAC keyrings.
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Keyring holds a set of HMAC keys, identified by number, for
+// authenticating transmissions. Each transmission carries the ID of
+// the key which signed it, so keys can be changed without restarting
+// every Client and Server at once. A typical rotation is:
+//
+//  1. Add the new key, verify-only, to every Keyring
+//  2. Make it active everywhere, and Use it on Clients
+//  3. Mark the old key verify-only, then Remove it
+//
+// Transmissions signed with any key in the Keyring are accepted;
+// verify-only keys are never used for signing. Clients sign with the
+// Keyring's signing key (see Use). Servers answer each request with
+// the key which signed it, if that key is active, and otherwise with
+// their own signing key.
+//
+// A Keyring is safe for concurrent use, and may be changed or
+// reloaded while Servers and Clients are using it.
+type Keyring struct {
+	m    sync.RWMutex
+	keys map[uint32]*ringKey
+	// id of the signing key, and whether there is one
+	cur uint32
+	ok  bool
+}
+
+// ringKey is a key in a Keyring.
+type ringKey struct {
+	k  []byte
+	vo bool // verify-only
+}
+
+// NewKeyring returns an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[uint32]*ringKey{}}
+}
+
+// Add puts a key in the Keyring, replacing any key with the same
+// ID. If the Keyring has no signing key, and the new key is not
+// verify-only, it becomes the signing key.
+func (kr *Keyring) Add(id uint32, key []byte, verifyOnly bool) error {
+	if len(key) == 0 {
+		return fmt.Errorf("key %d is empty", id)
+	}
+	kr.m.Lock()
+	defer kr.m.Unlock()
+	if kr.ok && kr.cur == id && verifyOnly {
+		return fmt.Errorf("key %d is the signing key", id)
+	}
+	kr.keys[id] = &ringKey{append([]byte{}, key...), verifyOnly}
+	if !kr.ok && !verifyOnly {
+		kr.cur, kr.ok = id, true
+	}
+	return nil
+}
+
+// Remove takes a key out of the Keyring. If it was the signing key,
+// the Keyring has no signing key until Use is called.
+func (kr *Keyring) Remove(id uint32) {
+	kr.m.Lock()
+	defer kr.m.Unlock()
+	delete(kr.keys, id)
+	if kr.cur == id {
+		kr.ok = false
+	}
+}
+
+// Use makes a key the signing key. It must be in the Keyring, and
+// not verify-only.
+func (kr *Keyring) Use(id uint32) error {
+	kr.m.Lock()
+	defer kr.m.Unlock()
+	k, ok := kr.keys[id]
+	if !ok {
+		return fmt.Errorf("key %d is not in the keyring", id)
+	}
+	if k.vo {
+		return fmt.Errorf("key %d is verify-only", id)
+	}
+	kr.cur, kr.ok = id, true
+	return nil
+}
+
+// SetVerifyOnly changes whether a key is verify-only. The signing
+// key cannot be made verify-only.
+func (kr *Keyring) SetVerifyOnly(id uint32, verifyOnly bool) error {
+	kr.m.Lock()
+	defer kr.m.Unlock()
+	k, ok := kr.keys[id]
+	if !ok {
+		return fmt.Errorf("key %d is not in the keyring", id)
+	}
+	if kr.ok && kr.cur == id && verifyOnly {
+		return fmt.Errorf("key %d is the signing key", id)
+	}
+	k.vo = verifyOnly
+	return nil
+}
+
+// Load replaces the contents of the Keyring with keys read from r,
+// in a single step. Each line holds a key ID, the key (base64
+// encoded), and optionally a flag:
+//
+//	# comments and blank lines are ignored
+//	1 b2xkIGtleQ== verify
+//	2 bmV3IGtleQ== sign
+//	3 bmV4dCBrZXk=
+//
+// "verify" marks a key as verify-only, and "sign" makes a key the
+// signing key. If no key is marked "sign", the first active key
+// is. On error, the Keyring is left unchanged.
+func (kr *Keyring) Load(r io.Reader) error {
+	keys := map[uint32]*ringKey{}
+	var cur uint32
+	var ok, signer bool
+	sc := bufio.NewScanner(r)
+	for ln := 1; sc.Scan(); ln++ {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if len(f) < 2 || len(f) > 3 {
+			return fmt.Errorf("keyring line %d: expected 'id key [flag]'", ln)
+		}
+		id, err := strconv.ParseUint(f[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("keyring line %d: bad key id: %s", ln, err)
+		}
+		k, err := base64.StdEncoding.DecodeString(f[1])
+		if err != nil || len(k) == 0 {
+			return fmt.Errorf("keyring line %d: bad key", ln)
+		}
+		if _, dup := keys[uint32(id)]; dup {
+			return fmt.Errorf("keyring line %d: duplicate key id %d", ln, id)
+		}
+		rk := &ringKey{k: k}
+		if len(f) == 3 {
+			switch f[2] {
+			case "verify":
+				rk.vo = true
+			case "sign":
+				if signer {
+					return fmt.Errorf("keyring line %d: more than one signing key", ln)
+				}
+				cur, ok, signer = uint32(id), true, true
+			default:
+				return fmt.Errorf("keyring line %d: unknown flag '%s'", ln, f[2])
+			}
+		}
+		if !ok && !rk.vo {
+			cur, ok = uint32(id), true
+		}
+		keys[uint32(id)] = rk
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	kr.m.Lock()
+	kr.keys, kr.cur, kr.ok = keys, cur, ok
+	kr.m.Unlock()
+	return nil
+}
+
+// LoadFile is Load, reading from the named file. It is meant for
+// reloading a Keyring at runtime -- on SIGHUP, for instance.
+func (kr *Keyring) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return kr.Load(f)
+}
+
+// key returns the key with the given ID, if the Keyring has it.
+func (kr *Keyring) key(id uint32) ([]byte, bool) {
+	kr.m.RLock()
+	defer kr.m.RUnlock()
+	k, ok := kr.keys[id]
+	if !ok {
+		return nil, false
+	}
+	return k.k, true
+}
+
+// signer returns the key to sign with: the one with ID 'pref', if
+// 'usePref' is set and that key is active, or else the signing key.
+func (kr *Keyring) signer(pref uint32, usePref bool) (uint32, []byte, error) {
+	kr.m.RLock()
+	defer kr.m.RUnlock()
+	if k, ok := kr.keys[pref]; usePref && ok && !k.vo {
+		return pref, k.k, nil
+	}
+	if !kr.ok {
+		return 0, nil, fmt.Errorf("keyring has no signing key")
+	}
+	return kr.cur, kr.keys[kr.cur].k, nil
+}
+
+// ringSealer authenticates transmissions with keys from a Keyring,
+// using protocol version ProtoKeyed. Its header fields are the key ID
+// (uint32) and a base64 HMAC of the payload. One is made for each
+// connection.
+type ringSealer struct {
+	kr *Keyring
+	// answer with the peer's key (Servers do, Clients don't)
+	rp bool
+	m  sync.Mutex
+	pk uint32 // ID of the key the peer last used
+	pv bool   // pk is valid
+}
+
+func (rs *ringSealer) ver() uint8 { return ProtoKeyed }
+func (rs *ringSealer) hlen() int  { return 48 }
+
+func (rs *ringSealer) seal(seq uint32, payload []byte) ([]byte, error) {
+	id, key, err := rs.signKey()
+	if err != nil {
+		return nil, err
+	}
+	xmission := xheader(seq, uint32(len(payload)), ProtoKeyed)
+	xmission = append(xmission, make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(xmission[9:13], id)
+	xmission = append(xmission, mac64(key, payload)...)
+	return append(xmission, payload...), nil
+}
+
+func (rs *ringSealer) open(hdr, body []byte) ([]byte, string, string) {
+	id := binary.LittleEndian.Uint32(hdr[9:13])
+	key, ok := rs.verifyKey(id)
+	if !ok || !hmac.Equal(hdr[13:], mac64(key, body)) {
+		return nil, "", "badmac"
+	}
+	return body, rs.verified(id), ""
+}
+
+func (rs *ringSealer) signKey() (uint32, []byte, error) {
+	rs.m.Lock()
+	pk, pv := rs.pk, rs.pv && rs.rp
+	rs.m.Unlock()
+	return rs.kr.signer(pk, pv)
+}
+
+func (rs *ringSealer) verifyKey(id uint32) ([]byte, bool) {
+	return rs.kr.key(id)
+}
+
+func (rs *ringSealer) verified(id uint32) string {
+	rs.m.Lock()
+	rs.pk, rs.pv = id, true
+	rs.m.Unlock()
+	return fmt.Sprintf("hmac:%d", id)
+}
@@ -0,0 +1,324 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements Server load limiting.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// refuseTime is how long the Server spends on a client which it is
+// refusing, all told: the handshake (if any), the notice, and
+// lingerClose.
+var refuseTime = time.Second
+
+// refuseMax is how many clients the Server will be refusing at once.
+// Past that, further clients are hung up on without a notice.
+var refuseMax int32 = 64
+
+// errBusy is returned when a request is refused because too many
+// others are running or waiting to run.
+var errBusy = errors.New("server busy")
+
+// limiter caps the number of requests running concurrently, with a
+// bounded queue of requests waiting for a slot. A nil limiter
+// imposes no limit.
+type limiter struct {
+	// one token per running or waiting request
+	adm chan bool
+	// one token per running request
+	sem chan bool
+}
+
+// newLimiter returns a limiter which allows n concurrent requests,
+// with up to q more waiting. If n is less than 1, it returns nil.
+func newLimiter(n, q int) *limiter {
+	if n < 1 {
+		return nil
+	}
+	if q < 0 {
+		q = 0
+	}
+	return &limiter{adm: make(chan bool, n+q), sem: make(chan bool, n)}
+}
+
+// acquire waits for a slot. It returns errBusy if the queue is full,
+// or the Context's error if the Context is cancelled while waiting.
+// Every successful acquire must be paired with a release.
+func (l *limiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.adm <- true:
+	default:
+		return errBusy
+	}
+	select {
+	case l.sem <- true:
+		return nil
+	case <-ctx.Done():
+		<-l.adm
+		return ctx.Err()
+	}
+}
+
+// release frees a slot.
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+	<-l.adm
+}
+
+// Limit returns an Interceptor which allows at most n concurrent
+// requests for a command, with up to 'queue' more waiting. Requests
+// beyond that are refused with a "server busy" error (status
+// 503). Pass it to Register to limit a single command; passing the
+// same Interceptor to several commands makes them share the limit.
+func Limit(n, queue int) Interceptor {
+	l := newLimiter(n, queue)
+	return func(ctx context.Context, ri *ReqInfo, args [][]byte, next ContextResponder) ([]byte, error) {
+		if err := l.acquire(ctx); err != nil {
+			return nil, err
+		}
+		// the slot is held until the Responder returns, even
+		// if it runs past its deadline
+		defer ri.release(l.release)
+		return next(ctx, ri, args)
+	}
+}
+
+// bucket is a token bucket. Tokens accumulate at a fixed rate, up to
+// a maximum, and each event takes one.
+type bucket struct {
+	m sync.Mutex
+	// rate, in tokens per second
+	r float64
+	// capacity
+	b float64
+	// tokens on hand, as of t
+	n float64
+	t time.Time
+}
+
+// newBucket returns a full bucket. If burst is less than 1, the
+// capacity is the rate.
+func newBucket(rate float64, burst int) *bucket {
+	b := float64(burst)
+	if b < 1 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &bucket{r: rate, b: b, n: b, t: time.Now()}
+}
+
+// take removes a token from the bucket if one is available. If not,
+// it returns false and the time until one will be. A nil bucket
+// always has tokens.
+func (b *bucket) take() (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	now := time.Now()
+	b.n += now.Sub(b.t).Seconds() * b.r
+	if b.n > b.b {
+		b.n = b.b
+	}
+	b.t = now
+	if b.n >= 1 {
+		b.n--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.n) / b.r * float64(time.Second))
+}
+
+// full reports whether the bucket will have refilled by 'now'.
+func (b *bucket) full(now time.Time) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.n+now.Sub(b.t).Seconds()*b.r >= b.b
+}
+
+// RateLimit configures a token-bucket rate limit.
+type RateLimit struct {
+	// Rate is the number of requests per second allowed, on
+	// average.
+	Rate float64
+	// Burst is the number of requests which may be made at once,
+	// after a quiet period. Defaults to Rate.
+	Burst int
+}
+
+// bucket returns a new bucket for a RateLimit, or nil if there is no
+// limit.
+func (rl *RateLimit) bucket() *bucket {
+	if rl == nil || rl.Rate <= 0 {
+		return nil
+	}
+	return newBucket(rl.Rate, rl.Burst)
+}
+
+// sweepInterval is how often a bucketMap discards buckets which have
+// refilled, and so are no longer doing anything.
+var sweepInterval = time.Minute
+
+// bucketMap holds a rate limit bucket per key. A nil bucketMap
+// imposes no limit.
+type bucketMap struct {
+	m  sync.Mutex
+	rl *RateLimit
+	b  map[string]*bucket
+	// time of the last sweep
+	sw time.Time
+}
+
+// newBucketMap returns a bucketMap for a RateLimit, or nil if there
+// is no limit.
+func newBucketMap(rl *RateLimit) *bucketMap {
+	if rl == nil || rl.Rate <= 0 {
+		return nil
+	}
+	return &bucketMap{rl: rl, b: map[string]*bucket{}, sw: time.Now()}
+}
+
+// take takes a token from the bucket for 'key', as bucket.take
+// does. The empty key is not limited.
+func (bm *bucketMap) take(key string) (bool, time.Duration) {
+	if bm == nil || key == "" {
+		return true, 0
+	}
+	bm.m.Lock()
+	now := time.Now()
+	if now.Sub(bm.sw) > sweepInterval {
+		for k, b := range bm.b {
+			if b.full(now) {
+				delete(bm.b, k)
+			}
+		}
+		bm.sw = now
+	}
+	b, ok := bm.b[key]
+	if !ok {
+		b = bm.rl.bucket()
+		bm.b[key] = b
+	}
+	bm.m.Unlock()
+	return b.take()
+}
+
+// connLimiter decides whether new connections are admitted. A nil
+// connLimiter admits everything.
+type connLimiter struct {
+	m sync.Mutex
+	// max conns, overall and per IP
+	max   int
+	maxIP int
+	// open conns, overall and per IP
+	n   int
+	ips map[string]int
+	// accept rate
+	ar *bucket
+}
+
+// newConnLimiter returns a connLimiter for a ServerConfig, or nil if
+// it sets no connection limits.
+func newConnLimiter(c *ServerConfig) *connLimiter {
+	if c.MaxConns < 1 && c.MaxConnsPerIP < 1 && c.AcceptRate < 1 {
+		return nil
+	}
+	l := &connLimiter{
+		max:   c.MaxConns,
+		maxIP: c.MaxConnsPerIP,
+		ips:   map[string]int{},
+	}
+	if c.AcceptRate > 0 {
+		l.ar = newBucket(float64(c.AcceptRate), c.AcceptBurst)
+	}
+	return l
+}
+
+// ipMask returns a mask of the given prefix length, or of 'bits' if
+// the length is out of range.
+func ipMask(ones, bits int) net.IPMask {
+	if ones < 1 || ones > bits {
+		ones = bits
+	}
+	return net.CIDRMask(ones, bits)
+}
+
+// ipKey returns the address of a client, masked for grouping, as a
+// string. It returns "" for addresses which are not IPs.
+func ipKey(addr net.Addr, m4, m6 net.IPMask) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(m4).String()
+	}
+	return ip.Mask(m6).String()
+}
+
+// admit checks a new connection, from the address 'key' (see ipKey),
+// against the limits. If it is not admitted, admit returns the reason
+// why. Otherwise the connection is counted, and done must be called
+// when it closes.
+func (l *connLimiter) admit(key string) string {
+	if l == nil {
+		return ""
+	}
+	if l.ar != nil {
+		if ok, _ := l.ar.take(); !ok {
+			return "accept rate exceeded"
+		}
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.max > 0 && l.n >= l.max {
+		return "too many connections"
+	}
+	if l.maxIP > 0 && key != "" && l.ips[key] >= l.maxIP {
+		return "too many connections from this address"
+	}
+	l.n++
+	if key != "" {
+		l.ips[key]++
+	}
+	return ""
+}
+
+// done releases a connection counted by admit.
+func (l *connLimiter) done(key string) {
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.n--
+	if key == "" {
+		return
+	}
+	if l.ips[key]--; l.ips[key] <= 0 {
+		delete(l.ips, key)
+	}
+}
@@ -0,0 +1,65 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Unix peer credentials for petrel
+
+import (
+	"fmt"
+	"net"
+)
+
+// PeerCred holds the credentials of the process at the other end of
+// a Unix domain socket connection, as reported by the kernel when the
+// connection was made.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// String returns the credentials in a form suitable for logging.
+func (pc *PeerCred) String() string {
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", pc.PID, pc.UID, pc.GID)
+}
+
+// PeerCredOf returns the credentials of the peer of a Unix domain
+// socket connection. It returns nil for other kinds of connection,
+// and on platforms where peer credentials are not supported (only
+// Linux is, at present).
+func PeerCredOf(c net.Conn) *PeerCred {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	return peerCred(uc)
+}
+
+// peerAllowed checks a Unix peer's credentials against the Server's
+// allowlists. Connections which aren't over Unix sockets are not
+// checked.
+func (s *Server) peerAllowed(c net.Conn, pc *PeerCred) bool {
+	if len(s.pu) == 0 && len(s.pg) == 0 {
+		return true
+	}
+	if _, ok := c.(*net.UnixConn); !ok {
+		return true
+	}
+	if pc == nil {
+		// we can't tell who this is
+		return false
+	}
+	for _, uid := range s.pu {
+		if pc.UID == uid {
+			return true
+		}
+	}
+	for _, gid := range s.pg {
+		if pc.GID == gid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+import (
+	"net"
+)
+
+// peerCred is not supported on this platform.
+func peerCred(uc *net.UnixConn) *PeerCred {
+	return nil
+}
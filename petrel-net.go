@@ -5,85 +5,127 @@ package petrel
 // BSD-style license that can be found in the LICENSE file.
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
-var (
-	pverbuf = new(bytes.Buffer)
-)
+// A sealer authenticates transmissions, and may also transform their
+// payloads. Each kind of sealer has its own protocol version, and may
+// add fields to the transmission header, after the version byte.
+type sealer interface {
+	// ver returns the protocol version the sealer reads and
+	// writes
+	ver() uint8
+	// hlen returns the number of header bytes the sealer adds
+	hlen() int
+	// seal turns a payload into a complete transmission
+	seal(seq uint32, payload []byte) ([]byte, error)
+	// open checks a transmission, given its full header and its
+	// body, and returns the payload and the identity of the
+	// sender (if the sealer establishes one). On failure, it
+	// returns the name of a Perr instead.
+	open(hdr, body []byte) ([]byte, string, string)
+}
+
+// hmacSealer signs payloads with a single HMAC key. This is the
+// original authentication scheme, and uses protocol version Proto.
+type hmacSealer []byte
+
+func (k hmacSealer) ver() uint8 { return Proto }
+func (k hmacSealer) hlen() int  { return 44 }
+
+func (k hmacSealer) seal(seq uint32, payload []byte) ([]byte, error) {
+	xmission := xheader(seq, uint32(len(payload)), Proto)
+	xmission = append(xmission, mac64(k, payload)...)
+	return append(xmission, payload...), nil
+}
+
+func (k hmacSealer) open(hdr, body []byte) ([]byte, string, string) {
+	if !hmac.Equal(hdr[9:], mac64(k, body)) {
+		return nil, "", "badmac"
+	}
+	return body, "", ""
+}
+
+func (k hmacSealer) signKey() (uint32, []byte, error)   { return 0, k, nil }
+func (k hmacSealer) verifyKey(id uint32) ([]byte, bool) { return k, true }
+func (k hmacSealer) verified(id uint32) string          { return "" }
+
+// mac64 returns the base64-encoded HMAC-SHA256 of data.
+func mac64(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	macb64 := make([]byte, 44)
+	base64.StdEncoding.Encode(macb64, mac.Sum(nil))
+	return macb64
+}
 
-func init() {
-	// pre-compute the binary encoding of Proto
-	binary.Write(pverbuf, binary.LittleEndian, Proto)
+// xheader encodes the part of a transmission header which is common
+// to all protocol versions.
+func xheader(seq, plen uint32, pver uint8) []byte {
+	hdr := make([]byte, 9)
+	binary.LittleEndian.PutUint32(hdr[0:4], seq)
+	binary.LittleEndian.PutUint32(hdr[4:8], plen)
+	hdr[8] = pver
+	return hdr
 }
 
-func connRead(c net.Conn, timeout time.Duration, plimit uint32, key []byte, seq *uint32) ([]byte, string, string, error) {
+// connRead reads a transmission. If sl is not nil, the transmission
+// must have been sealed by a matching sealer. The sequence id is
+// stored in seq and, if id is not nil, the identity of the sender is
+// stored in id. If hdr is not nil, the transmission header as read
+// (sealer fields included) is stored in hdr.
+func connRead(c net.Conn, timeout time.Duration, plimit uint32, sl sealer, seq *uint32, id *string, hdr *[]byte) ([]byte, string, string, error) {
 	// buffer 0 holds the transmission header
 	b0 := make([]byte, 9)
 	// buffer 1: network reads go here, 128B at a time
 	b1 := make([]byte, 128)
 	// buffer 2: data accumulates here; payload pulled from here when done
 	var b2 []byte
-	// pmac is the HMAC256 value which came in with the payload
-	pmac := make([]byte, 44)
-	// pver holds the protocol version
-	var pver uint8
+	// pver holds the expected protocol version
+	pver := Proto
 	// plen holds the payload length
 	var plen uint32
 	// bread is bytes read so far
 	var bread uint32
 
 	// read the transmission header
-	if key != nil {
-		// if we have an HMAC, header is 53 bytes instead of 9
-		b0 = make([]byte, 53)
+	if sl != nil {
+		pver = sl.ver()
 	}
 	if timeout > 0 {
 		c.SetReadDeadline(time.Now().Add(timeout))
 	}
-	n, err := c.Read(b0)
+	n, err := io.ReadFull(c, b0)
 	if err != nil {
 		if err == io.EOF {
 			return nil, "disconnect", "", err
 		}
+		if n > 0 {
+			return nil, "netreaderr", "short read on xmission header", err
+		}
 		return nil, "netreaderr", "no xmission header", err
 	}
-	if n != cap(b0) {
-		return nil, "netreaderr", "short read on xmission header", err
-	}
-	// decode the sequence id
-	buf := bytes.NewReader(b0[0:4])
-	err = binary.Read(buf, binary.LittleEndian, seq)
-	if err != nil {
-		return nil, "internalerr", "could not decode seqnum", err
-	}
-	// decode the payload length
-	buf = bytes.NewReader(b0[4:8])
-	err = binary.Read(buf, binary.LittleEndian, &plen)
-	if err != nil {
-		return nil, "internalerr", "could not decode payload length", err
-	}
-	// decode and validate the version
-	buf = bytes.NewReader(b0[8:9])
-	err = binary.Read(buf, binary.LittleEndian, &pver)
-	if err != nil {
-		return nil, "internalerr", "could not decode protocol version", err
-	}
-	if pver != Proto {
+	// decode the sequence id and payload length
+	*seq = binary.LittleEndian.Uint32(b0[0:4])
+	plen = binary.LittleEndian.Uint32(b0[4:8])
+	// validate the version
+	if b0[8] != pver {
 		return nil, "internalerr", "protocol mismatch", err
 	}
-	// and, optionally, extract the HMAC
-	if key != nil {
-		pmac = b0[9:]
-		if len(pmac) != 44 {
-			return nil, "netreaderr", "short read on HMAC", err
+	// and, optionally, read the sealer's part of the header
+	if sl != nil {
+		b0 = append(b0, make([]byte, sl.hlen())...)
+		if _, err = io.ReadFull(c, b0[9:]); err != nil {
+			return nil, "netreaderr", "short read on xmission header", err
 		}
 	}
 
@@ -113,48 +155,31 @@ func connRead(c net.Conn, timeout time.Duration, plimit uint32, key []byte, seq
 	}
 	b2 = b2[:plen]
 
-	// finally, if we have a MAC, verify it
-	if key != nil {
-		mac := hmac.New(sha256.New, key)
-		mac.Write(b2)
-		expectedMAC := make([]byte, 44)
-		base64.StdEncoding.Encode(expectedMAC, mac.Sum(nil))
-		if !hmac.Equal(pmac, expectedMAC) {
-			return nil, "badmac", "", nil
-		}
-	}
-	return b2, "", "", err
-}
-
-// connReadRaw is only used by the Client, via DispatchRaw. As such it
-// has no payload length checking.
-func connReadRaw(c net.Conn, timeout time.Duration) ([]byte, string, string, error) {
-	// buffer 1: network reads go here, 128B at a time
-	b1 := make([]byte, 128)
-	// buffer 2: data accumulates here; payload pulled from here when done
-	var b2 []byte
-	for {
-		if timeout > 0 {
-			c.SetReadDeadline(time.Now().Add(timeout))
+	// finally, if we have a sealer, let it check the transmission
+	if sl != nil {
+		var who, perr string
+		b2, who, perr = sl.open(b0, b2)
+		if perr != "" {
+			return nil, perr, "", nil
 		}
-		n, err := c.Read(b1)
-		if err != nil {
-			if err == io.EOF {
-				return nil, "disconnect", "", err
-			}
-			return nil, "netreaderr", "failed to read req from socket", err
-		}
-		if n < 128 {
-			b2 = append(b2, b1[:n]...)
-			break
+		if id != nil {
+			*id = who
 		}
-		b2 = append(b2, b1...)
 	}
-	return b2, "", "", nil
+	if hdr != nil {
+		*hdr = b0[:len(b0):len(b0)]
+	}
+	return b2, "", "", err
 }
 
-func connWrite(c net.Conn, payload, key []byte, timeout time.Duration, seq uint32) (string, error) {
-	xmission, internalerr, err := marshalXmission(payload, key, seq)
+func connWrite(c net.Conn, payload []byte, sl sealer, timeout time.Duration, seq uint32) (string, error) {
+	if l, ok := sl.(sync.Locker); ok {
+		// the sealer's state must advance in the same order
+		// that transmissions go out
+		l.Lock()
+		defer l.Unlock()
+	}
+	xmission, internalerr, err := marshalXmission(payload, sl, seq)
 	if err != nil {
 		return internalerr, err
 	}
@@ -164,7 +189,7 @@ func connWrite(c net.Conn, payload, key []byte, timeout time.Duration, seq uint3
 
 func connWriteRaw(c net.Conn, timeout time.Duration, xmission []byte) (string, error) {
 	if timeout > 0 {
-		c.SetReadDeadline(time.Now().Add(timeout))
+		c.SetWriteDeadline(time.Now().Add(timeout))
 	}
 	_, err := c.Write(xmission)
 	if err != nil {
@@ -179,34 +204,15 @@ func connWriteRaw(c net.Conn, timeout time.Duration, xmission []byte) (string, e
 //    Sequence        uint32 (4 bytes)
 //    Payload length  uint32 (4 bytes)
 //    Protocol ver    uint8  (1 byte)
-//    HMAC            32 bytes, optional
+//    Sealer fields   per protocol version (HMAC is 44 bytes)
 //    Payload         Per payload length
-func marshalXmission(payload, key []byte, seq uint32) ([]byte, string, error) {
-	xmission := []byte{}
-	// encode xmit seq
-	seqbuf := new(bytes.Buffer)
-	err := binary.Write(seqbuf, binary.LittleEndian, seq)
-	if err != nil {
-		return nil, "internalerr", err
-	}
-	// encode payload length
-	plen := new(bytes.Buffer)
-	err = binary.Write(plen, binary.LittleEndian, uint32(len(payload)))
-	if err != nil {
-		return nil, "internalerr", err
-	}
-	// assemble xmission
-	xmission = append(xmission, seqbuf.Bytes()...)
-	xmission = append(xmission, plen.Bytes()...)
-	xmission = append(xmission, pverbuf.Bytes()...)
-	// encode and append HMAC if needed
-	if key != nil {
-		mac := hmac.New(sha256.New, key)
-		mac.Write(payload)
-		macb64 := make([]byte, 44)
-		base64.StdEncoding.Encode(macb64, mac.Sum(nil))
-		xmission = append(xmission, macb64...)
+func marshalXmission(payload []byte, sl sealer, seq uint32) ([]byte, string, error) {
+	if sl != nil {
+		xmission, err := sl.seal(seq, payload)
+		if err != nil {
+			return nil, "internalerr", err
+		}
+		return xmission, "", nil
 	}
-	xmission = append(xmission, payload...)
-	return xmission, "", err
+	return append(xheader(seq, uint32(len(payload)), Proto), payload...), "", nil
 }
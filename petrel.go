@@ -6,6 +6,24 @@ package petrel // import "github.com/firepear/petrel"
 
 const (
 	// Proto is the version of the wire protocol implemented by
-	// this library
-	Proto = uint8(0)
+	// this library. It was 0 until error frames gained a kind
+	// and message; Servers and Clients which speak version 0
+	// can't talk to this one.
+	Proto = uint8(1)
+
+	// ProtoKeyed is the protocol version of transmissions signed
+	// with a Keyring, which carry the ID of their key
+	ProtoKeyed = uint8(2)
+
+	// ProtoReplay is the protocol version of replay-protected
+	// transmissions (see ServerConfig.ReplayWindow)
+	ProtoReplay = uint8(3)
+
+	// ProtoSigned is the protocol version of transmissions signed
+	// with Ed25519 keys (see ServerConfig.SignKey)
+	ProtoSigned = uint8(4)
+
+	// ProtoSealed is the protocol version of transmissions
+	// encrypted with a pre-shared key (see ServerConfig.PSK)
+	ProtoSealed = uint8(5)
 )
@@ -0,0 +1,338 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements the Petrel client pool.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ClientPool maintains a set of Clients connected to a single
+// Server. Clients which have been closed due to errors are discarded
+// and replaced as needed. A ClientPool is safe for concurrent use by
+// multiple goroutines.
+type ClientPool struct {
+	// dial creates a new Client
+	dial func() (*Client, error)
+	// idle Clients
+	idle chan *idleClient
+	// one token per open Client
+	sem chan bool
+	// quit channel
+	q chan bool
+	// janitor WaitGroup
+	w sync.WaitGroup
+	// guards closing q
+	m sync.Mutex
+	// closed flag
+	pc bool
+	// min and max idle Clients
+	mni int
+	mxi int
+	// idle timeout
+	it time.Duration
+	// probe interval and request
+	pi time.Duration
+	pr []byte
+}
+
+// idleClient is a Client sitting in the pool, with the time it was
+// returned
+type idleClient struct {
+	c *Client
+	t time.Time
+}
+
+// PoolConfig holds values to be passed to the pool constructors, in
+// addition to a ClientConfig.
+type PoolConfig struct {
+	// Size is the maximum number of open connections. When all
+	// of them are in use, Get blocks until one is returned. It
+	// must be at least 1.
+	Size int
+
+	// MinIdle is the number of idle connections the pool will
+	// try to keep available. Default is zero.
+	MinIdle int
+
+	// MaxIdle is the maximum number of idle connections. Clients
+	// returned to a pool which already holds this many are
+	// closed. Defaults to Size.
+	MaxIdle int
+
+	// IdleTimeout is the number of milliseconds a connection may
+	// sit idle before being closed (connections below MinIdle are
+	// kept regardless). Default (zero) is no timeout.
+	IdleTimeout int64
+
+	// Probe is the number of milliseconds between health checks
+	// of idle connections. Default (zero) is no health checks.
+	Probe int64
+
+	// ProbeReq is the request sent to check a connection's
+	// health. Any response, including an error response, means
+	// the connection is healthy; a timeout or a closed connection
+	// means it will be replaced. Probes time out after the Probe
+	// interval, or the Client's Timeout if that is shorter.
+	// Defaults to the nil request, which all Servers answer.
+	ProbeReq []byte
+}
+
+// TCPClientPool returns a ClientPool of TCP Clients.
+func TCPClientPool(c *ClientConfig, p *PoolConfig) (*ClientPool, error) {
+	return newPool(p, func() (*Client, error) { return TCPClient(c) })
+}
+
+// TLSClientPool returns a ClientPool of TLS Clients.
+func TLSClientPool(c *ClientConfig, t *tls.Config, p *PoolConfig) (*ClientPool, error) {
+	return newPool(p, func() (*Client, error) { return TLSClient(c, t) })
+}
+
+// UnixClientPool returns a ClientPool of Unix domain socket Clients.
+func UnixClientPool(c *ClientConfig, p *PoolConfig) (*ClientPool, error) {
+	return newPool(p, func() (*Client, error) { return UnixClient(c) })
+}
+
+// newPool does shared setup work for the pool constructors
+func newPool(p *PoolConfig, dial func() (*Client, error)) (*ClientPool, error) {
+	if p.Size < 1 {
+		return nil, fmt.Errorf("pool size must be at least 1")
+	}
+	if p.MaxIdle < 1 || p.MaxIdle > p.Size {
+		p.MaxIdle = p.Size
+	}
+	if p.MinIdle > p.MaxIdle {
+		return nil, fmt.Errorf("MinIdle (%d) is greater than MaxIdle (%d)", p.MinIdle, p.MaxIdle)
+	}
+	if p.ProbeReq == nil {
+		p.ProbeReq = []byte{}
+	}
+	cp := &ClientPool{
+		dial: dial,
+		idle: make(chan *idleClient, p.Size),
+		sem:  make(chan bool, p.Size),
+		q:    make(chan bool),
+		mni:  p.MinIdle,
+		mxi:  p.MaxIdle,
+		it:   time.Duration(p.IdleTimeout) * time.Millisecond,
+		pi:   time.Duration(p.Probe) * time.Millisecond,
+		pr:   p.ProbeReq,
+	}
+	// open the minimum number of idle conns
+	if err := cp.fill(); err != nil {
+		cp.Close()
+		return nil, err
+	}
+	// the janitor runs at the probe interval if there is one, or
+	// often enough to enforce the idle timeout
+	iv := cp.pi
+	if iv == 0 || (cp.it > 0 && cp.it/2 < iv) {
+		iv = cp.it / 2
+	}
+	if iv > 0 {
+		cp.w.Add(1)
+		go cp.janitor(iv)
+	}
+	return cp, nil
+}
+
+// Get returns a Client from the pool, opening a new connection if
+// no idle ones are available and the pool is not full. If the pool
+// is full, Get blocks until a Client is returned via Put. Clients
+// must be returned with Put when the caller is done with them.
+func (p *ClientPool) Get() (*Client, error) {
+	for {
+		// prefer an idle Client...
+		select {
+		case <-p.q:
+			return nil, fmt.Errorf("the pool has been closed")
+		case ic := <-p.idle:
+			if c := p.check(ic); c != nil {
+				return c, nil
+			}
+			continue
+		default:
+		}
+		// ...otherwise wait for either an idle Client or
+		// room to open a new one
+		select {
+		case ic := <-p.idle:
+			if c := p.check(ic); c != nil {
+				return c, nil
+			}
+		case p.sem <- true:
+			c, err := p.dial()
+			if err != nil {
+				<-p.sem
+				return nil, err
+			}
+			return c, nil
+		case <-p.q:
+			return nil, fmt.Errorf("the pool has been closed")
+		}
+	}
+}
+
+// Put returns a Client to the pool. Clients which have been closed
+// (by Client.Quit, or by a network or protocol error) are discarded,
+// freeing room for a replacement.
+func (p *ClientPool) Put(c *Client) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.pc || c.closed() || len(p.idle) >= p.mxi {
+		p.discard(c)
+		return
+	}
+	p.idle <- &idleClient{c, time.Now()}
+}
+
+// Dispatch gets a Client from the pool, uses it to send a request,
+// and returns it to the pool.
+func (p *ClientPool) Dispatch(req []byte) ([]byte, error) {
+	c, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(c)
+	return c.Dispatch(req)
+}
+
+// Close shuts down the pool and closes all idle connections. Clients
+// which are checked out are closed when they are returned.
+func (p *ClientPool) Close() {
+	p.m.Lock()
+	if p.pc {
+		p.m.Unlock()
+		return
+	}
+	p.pc = true
+	close(p.q)
+	p.m.Unlock()
+	p.w.Wait()
+	for {
+		select {
+		case ic := <-p.idle:
+			p.discard(ic.c)
+		default:
+			return
+		}
+	}
+}
+
+// Len returns the number of open connections, and how many of those
+// are idle.
+func (p *ClientPool) Len() (int, int) {
+	return len(p.sem), len(p.idle)
+}
+
+// check vets a Client taken from the idle queue, returning it if it
+// is usable and discarding it otherwise.
+func (p *ClientPool) check(ic *idleClient) *Client {
+	if ic.c.closed() {
+		p.discard(ic.c)
+		return nil
+	}
+	return ic.c
+}
+
+// discard closes a Client and frees its slot.
+func (p *ClientPool) discard(c *Client) {
+	c.Quit()
+	<-p.sem
+}
+
+// fill opens connections until there are at least MinIdle idle
+// ones, or the pool is full.
+func (p *ClientPool) fill() error {
+	for len(p.idle) < p.mni {
+		select {
+		case p.sem <- true:
+		default:
+			return nil
+		}
+		c, err := p.dial()
+		if err != nil {
+			<-p.sem
+			return err
+		}
+		p.idle <- &idleClient{c, time.Now()}
+	}
+	return nil
+}
+
+// probe health-checks an idle Client. A Client which doesn't answer
+// within the probe interval, or before the pool is closed, is
+// unhealthy, whether or not it has a Timeout of its own.
+func (p *ClientPool) probe(c *Client) bool {
+	// if we give up on the Dispatch, the Client is discarded,
+	// which ends it
+	ec := make(chan error, 1)
+	go func() {
+		_, err := c.Dispatch(p.pr)
+		ec <- err
+	}()
+	t := time.NewTimer(p.pi)
+	defer t.Stop()
+	select {
+	case err := <-ec:
+		ne, ok := err.(net.Error)
+		return !c.closed() && !(ok && ne.Timeout())
+	case <-t.C:
+	case <-p.q:
+	}
+	return false
+}
+
+// janitor periodically evicts and health-checks idle Clients, and
+// keeps the pool topped up to MinIdle.
+func (p *ClientPool) janitor(iv time.Duration) {
+	defer p.w.Done()
+	tick := time.NewTicker(iv)
+	defer tick.Stop()
+	var lastProbe time.Time
+	for {
+		select {
+		case <-p.q:
+			return
+		case <-tick.C:
+		}
+		probe := p.pi > 0 && time.Since(lastProbe) >= p.pi
+		if probe {
+			lastProbe = time.Now()
+		}
+		// look at each Client which is idle right now. anything
+		// checked out or returned meanwhile is left alone.
+		for n := len(p.idle); n > 0; n-- {
+			var ic *idleClient
+			select {
+			case ic = <-p.idle:
+			default:
+				n = 0
+				continue
+			}
+			if ic.c.closed() {
+				p.discard(ic.c)
+				continue
+			}
+			if p.it > 0 && time.Since(ic.t) > p.it && len(p.idle) >= p.mni {
+				p.discard(ic.c)
+				continue
+			}
+			if probe && !p.probe(ic.c) {
+				p.discard(ic.c)
+				continue
+			}
+			p.idle <- ic
+		}
+		// failure to reconnect isn't fatal here; we'll try
+		// again next time around
+		p.fill()
+	}
+}
@@ -0,0 +1,191 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements pre-shared-key encryption.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// newSealer sets up the sealer for a new connection.
+type newSealer func(net.Conn) (sealer, error)
+
+// handshakeTime is how long a Server gives a client to finish the
+// handshake, if the Server has no Timeout.
+var handshakeTime = 10 * time.Second
+
+// Handshake errors
+var (
+	errHandshake = errors.New("encryption handshake failed: protocol mismatch")
+	errBadPSK    = errors.New("encryption handshake failed: the Server does not have our PSK")
+)
+
+// When a connection is encrypted with a PSK, each side starts by
+// sending a hello. The Client's is ProtoSealed followed by 32 random
+// bytes, and the Server's is the same followed by a 32-byte key
+// confirmation. Both sides then derive the connection's keys from
+// the PSK and the two random values, HKDF-style:
+//
+//	prk     = HMAC(cr | sr, psk)
+//	confirm = HMAC(prk, "petrel confirm" | 1)
+//	c2s     = HMAC(prk, "petrel c2s" | 1)
+//	s2c     = HMAC(prk, "petrel s2c" | 1)
+//
+// The Client checks the confirmation, so it knows that the Server
+// has the PSK. The Server finds out that the Client does when the
+// first request decrypts.
+const helloLen = 33
+
+// pskKeys derives a connection's keys from the PSK and the hellos'
+// random values.
+func pskKeys(psk, cr, sr []byte) (confirm, c2s, s2c []byte) {
+	ext := hmac.New(sha256.New, append(append([]byte{}, cr...), sr...))
+	ext.Write(psk)
+	prk := ext.Sum(nil)
+	expand := func(info string) []byte {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write([]byte(info))
+		mac.Write([]byte{1})
+		return mac.Sum(nil)
+	}
+	return expand("petrel confirm"), expand("petrel c2s"), expand("petrel s2c")
+}
+
+// pskHello returns a hello, with its random value.
+func pskHello() ([]byte, error) {
+	hello := make([]byte, helloLen)
+	hello[0] = ProtoSealed
+	_, err := rand.Read(hello[1:])
+	return hello, err
+}
+
+// pskAccept does the Server's side of the handshake. The Server
+// sets the connection's deadline (see Server.handshake).
+func pskAccept(c net.Conn, psk []byte) (sealer, error) {
+	ch := make([]byte, helloLen)
+	if _, err := io.ReadFull(c, ch); err != nil {
+		return nil, err
+	}
+	if ch[0] != ProtoSealed {
+		return nil, errHandshake
+	}
+	sh, err := pskHello()
+	if err != nil {
+		return nil, err
+	}
+	confirm, c2s, s2c := pskKeys(psk, ch[1:], sh[1:])
+	if _, err = c.Write(append(sh, confirm...)); err != nil {
+		return nil, err
+	}
+	return newAEADSealer(s2c, c2s)
+}
+
+// pskConnect does the Client's side of the handshake.
+func pskConnect(c net.Conn, psk []byte, timeout time.Duration) (sealer, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+		defer c.SetDeadline(time.Time{})
+	}
+	ch, err := pskHello()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.Write(ch); err != nil {
+		return nil, err
+	}
+	sh := make([]byte, helloLen+sha256.Size)
+	if _, err = io.ReadFull(c, sh); err != nil {
+		return nil, err
+	}
+	if sh[0] != ProtoSealed {
+		return nil, errHandshake
+	}
+	confirm, c2s, s2c := pskKeys(psk, ch[1:], sh[1:helloLen])
+	if !hmac.Equal(confirm, sh[helloLen:]) {
+		return nil, errBadPSK
+	}
+	return newAEADSealer(c2s, s2c)
+}
+
+// aeadSealer encrypts transmissions with AES-256-GCM, using protocol
+// version ProtoSealed. Its only header field is the 16-byte GCM tag;
+// the payload is replaced by its ciphertext, which is the same
+// length. The standard header is authenticated along with the
+// payload.
+//
+// Each direction has its own key, and nonces are a count of the
+// transmissions sent in that direction, so they are never sent. This
+// means transmissions must be sealed in the order they are written,
+// and so aeadSealer is a sync.Locker, which connWrite holds while
+// sealing and writing.
+type aeadSealer struct {
+	sync.Mutex
+	tx cipher.AEAD
+	rx cipher.AEAD
+	// counts of transmissions sealed and opened
+	tn uint64
+	rn uint64
+}
+
+// newAEADSealer returns an aeadSealer which encrypts with key 'tx'
+// and decrypts with key 'rx'.
+func newAEADSealer(tx, rx []byte) (*aeadSealer, error) {
+	as := &aeadSealer{}
+	var err error
+	if as.tx, err = newGCM(tx); err != nil {
+		return nil, err
+	}
+	if as.rx, err = newGCM(rx); err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+// aeadNonce returns the nonce for transmission n.
+func aeadNonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+func (as *aeadSealer) ver() uint8 { return ProtoSealed }
+func (as *aeadSealer) hlen() int  { return 16 }
+
+func (as *aeadSealer) seal(seq uint32, payload []byte) ([]byte, error) {
+	hdr := xheader(seq, uint32(len(payload)), ProtoSealed)
+	ct := as.tx.Seal(nil, aeadNonce(as.tn), payload, hdr)
+	as.tn++
+	xmission := append(hdr, ct[len(payload):]...)
+	return append(xmission, ct[:len(payload)]...), nil
+}
+
+func (as *aeadSealer) open(hdr, body []byte) ([]byte, string, string) {
+	ct := append(append([]byte{}, body...), hdr[9:]...)
+	payload, err := as.rx.Open(ct[:0], aeadNonce(as.rn), ct, hdr[:9])
+	as.rn++
+	if err != nil {
+		return nil, "", "badmac"
+	}
+	return payload, "", ""
+}
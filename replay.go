@@ -0,0 +1,125 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements replay protection for HMAC-authenticated
+// transmissions.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// macKeys is implemented by the HMAC sealers, so that their keys can
+// be used by replaySealer.
+type macKeys interface {
+	sealer
+	// signKey returns the ID and value of the key to sign with
+	signKey() (uint32, []byte, error)
+	// verifyKey returns the key with the given ID
+	verifyKey(id uint32) ([]byte, bool)
+	// verified notes that the peer has used key 'id', and
+	// returns the peer's identity
+	verified(id uint32) string
+}
+
+// replaySealer authenticates transmissions with HMAC keys, using
+// protocol version ProtoReplay. Its header fields are:
+//
+//	Key ID          uint32 (4 bytes)
+//	Timestamp       int64  (8 bytes, Unix nanoseconds)
+//	Nonce           16 random bytes
+//	HMAC            44 bytes (base64)
+//
+// The HMAC covers the whole header up to itself, and the
+// payload. Transmissions which are too old (or too new), or whose
+// nonces have been seen before, are refused as replays.
+type replaySealer struct {
+	mk macKeys
+	nc *nonceCache
+}
+
+func (rs *replaySealer) ver() uint8 { return ProtoReplay }
+func (rs *replaySealer) hlen() int  { return 72 }
+
+func (rs *replaySealer) seal(seq uint32, payload []byte) ([]byte, error) {
+	id, key, err := rs.mk.signKey()
+	if err != nil {
+		return nil, err
+	}
+	xmission := xheader(seq, uint32(len(payload)), ProtoReplay)
+	xmission = append(xmission, make([]byte, 28)...)
+	binary.LittleEndian.PutUint32(xmission[9:13], id)
+	binary.LittleEndian.PutUint64(xmission[13:21], uint64(time.Now().UnixNano()))
+	if _, err = rand.Read(xmission[21:37]); err != nil {
+		return nil, err
+	}
+	xmission = append(xmission, mac64(key, xmission, payload)...)
+	return append(xmission, payload...), nil
+}
+
+func (rs *replaySealer) open(hdr, body []byte) ([]byte, string, string) {
+	id := binary.LittleEndian.Uint32(hdr[9:13])
+	key, ok := rs.mk.verifyKey(id)
+	if !ok || !hmac.Equal(hdr[37:], mac64(key, hdr[:37], body)) {
+		return nil, "", "badmac"
+	}
+	ts := int64(binary.LittleEndian.Uint64(hdr[13:21]))
+	if !rs.nc.fresh(ts, hdr[21:37]) {
+		return nil, "", "replay"
+	}
+	return body, rs.mk.verified(id), ""
+}
+
+// nonceCache remembers the nonces of recent transmissions. A
+// transmission is fresh if its timestamp is within the window of the
+// current time, and its nonce has not been seen. Nonces are forgotten
+// once their timestamps fall out of the window, since their
+// transmissions would be refused anyway.
+type nonceCache struct {
+	m sync.Mutex
+	w time.Duration
+	// nonces, with their expiry times
+	seen map[string]int64
+	// time of the last sweep
+	sw time.Time
+}
+
+// newNonceCache returns a nonceCache with a window of 'ms'
+// milliseconds.
+func newNonceCache(ms int64) *nonceCache {
+	return &nonceCache{
+		w:    time.Duration(ms) * time.Millisecond,
+		seen: map[string]int64{},
+		sw:   time.Now(),
+	}
+}
+
+// fresh checks a transmission's timestamp and nonce, and remembers
+// the nonce.
+func (nc *nonceCache) fresh(ts int64, nonce []byte) bool {
+	now := time.Now()
+	if d := now.Sub(time.Unix(0, ts)); d > nc.w || d < -nc.w {
+		return false
+	}
+	nc.m.Lock()
+	defer nc.m.Unlock()
+	if now.Sub(nc.sw) > nc.w {
+		for k, exp := range nc.seen {
+			if exp < now.UnixNano() {
+				delete(nc.seen, k)
+			}
+		}
+		nc.sw = now
+	}
+	if _, ok := nc.seen[string(nonce)]; ok {
+		return false
+	}
+	nc.seen[string(nonce)] = ts + int64(nc.w)
+	return true
+}
@@ -7,101 +7,485 @@ package petrel
 // Socket code for petrel
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/firepear/qsplit/v2"
 )
 
-// sockAccept monitors the listener socket and spawns connections for
+// srvListener is one of a Server's listener sockets.
+type srvListener struct {
+	name string
+	l    net.Listener
+}
+
+// sockAccept monitors a listener socket and spawns connections for
 // clients.
-func (s *Server) sockAccept() {
+func (s *Server) sockAccept(ln *srvListener) {
 	defer s.w.Done()
-	var cn uint32
-	for cn = 1; true; cn++ {
-		c, err := s.l.Accept()
+	for {
+		c, err := ln.l.Accept()
 		if err != nil {
-			select {
-			case <-s.q:
+			if s.stopping() {
 				// s.Quit() was invoked; close up shop
-				s.genMsg(0, 0, perrs["quit"], "", nil)
-				return
-			default:
-				// we've had a networking error
-				s.genMsg(0, 0, perrs["listenerfail"], "", err)
+				s.lgenMsg(ln.name, 0, 0, perrs["quit"], "", nil)
 				return
 			}
+			// we've had a networking error
+			s.lgenMsg(ln.name, 0, 0, perrs["listenerfail"], "", err)
+			return
 		}
-		// we have a new client
+		// connection ids are unique across all listeners
+		cn := atomic.AddUint32(&s.cn, 1)
+		// we have a new client. see if we should talk to it
+		key := ipKey(c.RemoteAddr(), s.m4, s.m6)
+		why := s.cl.admit(key)
 		s.w.Add(1)
-		go s.connServer(c, cn)
+		if why != "" {
+			go s.refuse(c, ln, cn, why)
+			continue
+		}
+		go s.connServer(c, ln, cn, key)
+	}
+}
+
+// refuse tells a client that it has not been admitted, and closes
+// its connection.
+func (s *Server) refuse(c net.Conn, ln *srvListener, cn uint32, why string) {
+	defer s.w.Done()
+	defer atomic.AddInt32(&s.rn, -1)
+	if atomic.AddInt32(&s.rn, 1) > refuseMax {
+		// a backlog of refusals has built up, so don't
+		// spend any time explaining this one
+		s.rejectMsg(c, ln, cn, "refused", why+" (no notice sent)")
+		c.Close()
+		return
+	}
+	// the whole refusal gets refuseTime, so that clients which
+	// stall can't tie it up. if there's a handshake, go through
+	// with it so the client can read the notice. if it fails,
+	// the client won't be able to anyway, so there's nothing
+	// more to do about that.
+	c.SetDeadline(time.Now().Add(refuseTime))
+	sl, _ := s.ns(c)
+	s.reject(c, ln, cn, sl, "refused", why)
+}
+
+// handshake sets up a connection's sealer. A client which doesn't
+// finish the handshake within the Server's Timeout (or handshakeTime,
+// if there is no Timeout) is dropped.
+func (s *Server) handshake(c net.Conn) (sealer, error) {
+	t := s.t
+	if t <= 0 {
+		t = handshakeTime
 	}
+	c.SetDeadline(time.Now().Add(t))
+	defer c.SetDeadline(time.Time{})
+	return s.ns(c)
+}
+
+// reject sends a client a notice that it will not be served, with
+// status 'perr', and closes its connection. The caller sets the
+// connection's deadline, which covers all of this.
+func (s *Server) reject(c net.Conn, ln *srvListener, cn uint32, sl sealer, perr, why string) {
+	s.rejectMsg(c, ln, cn, perr, why)
+	// sequence id 0 marks this as a notice, rather than a
+	// response to a request
+	connWrite(c, perrs[perr].frame(perr, why), sl, 0, 0)
+	lingerClose(c)
+}
+
+// rejectMsg reports that a client has been rejected.
+func (s *Server) rejectMsg(c net.Conn, ln *srvListener, cn uint32, perr, why string) {
+	if s.li {
+		why = fmt.Sprintf("%s: %s", c.RemoteAddr(), why)
+	}
+	s.lgenMsg(ln.name, cn, 0, perrs[perr], why, nil)
+}
+
+// lingerClose closes a connection after giving the client a chance
+// to read whatever was last sent to it. Closing a TCP socket which
+// has unread data in its receive buffer can cause the peer to see a
+// reset instead of that data, so we half-close, then discard
+// anything the client sends until it hangs up or the connection's
+// deadline passes.
+func lingerClose(c net.Conn) {
+	defer c.Close()
+	cw, ok := c.(interface{ CloseWrite() error })
+	if !ok {
+		return
+	}
+	if cw.CloseWrite() != nil {
+		return
+	}
+	io.Copy(ioutil.Discard, c)
 }
 
 // connServer dispatches commands from, and sends reponses to, a client. It
 // is launched, per-connection, from sockAccept().
-func (s *Server) connServer(c net.Conn, cn uint32) {
+// 'key' is the client's address, as grouped for per-IP limits.
+func (s *Server) connServer(c net.Conn, ln *srvListener, cn uint32, key string) {
 	defer s.w.Done()
+	defer s.cl.done(key)
 	defer c.Close()
 	// request id for this connection
 	var reqid uint32
+	// connection context, handed to ContextResponders. it is
+	// cancelled when this function returns (client disconnect
+	// or error) or when Quit is called.
+	ctx, cf := context.WithCancel(s.ctx)
+	defer cf()
+	// if pipelining is enabled, sem limits the number of
+	// in-flight requests and rw tracks them
+	var sem chan bool
+	var rw sync.WaitGroup
+	if s.pl > 1 {
+		sem = make(chan bool, s.pl)
+	}
+	// requests are read through bc, so that without pipelining
+	// the connection can be watched for the client hanging up
+	// while a ContextResponder runs
+	bc := &bufConn{c, bufio.NewReader(c)}
+	// register the connection, so that Shutdown can find it. it
+	// counts as busy until the handshake is done, so that it
+	// isn't told goodbye before it could read it
+	pc := PeerCredOf(c)
+	st := s.track(c, ln, cn, pc)
+	if sem == nil {
+		st.bc, st.cf = bc, cf
+	}
+	defer s.untrack(cn)
+	// this connection's sealer (if transmissions are
+	// authenticated or encrypted), and the identity it
+	// establishes for the current request (for Keyrings and
+	// Ed25519 keys)
+	sl, err := s.handshake(c)
+	if err != nil {
+		s.lgenMsg(ln.name, cn, 0, perrs["netreaderr"], "encryption handshake failed", err)
+		return
+	}
+	var kid string
+	// this connection's rate limit bucket, and the client's TLS
+	// identity, which is looked up once the handshake (if any)
+	// is done
+	cb := s.crl.bucket()
+	var tid string
+	var idk bool
+	// for Unix connections, see whether we want to talk to
+	// whoever is on the other end
+	if !s.peerAllowed(c, pc) {
+		why := "peer not allowed"
+		if pc != nil {
+			why = fmt.Sprintf("peer not allowed: %s", pc)
+		}
+		c.SetDeadline(time.Now().Add(refuseTime))
+		s.reject(c, ln, cn, sl, "badpeer", why)
+		return
+	}
+	// the connection is ready. if we're shutting down, this is
+	// where the client is told goodbye
+	s.cm.Lock()
+	st.sl = sl
+	s.cm.Unlock()
+	s.end(st, cn)
 
+	var xtra []string
 	if s.li {
-		s.genMsg(cn, reqid, perrs["connect"], c.RemoteAddr().String(), nil)
-	} else {
-		s.genMsg(cn, reqid, perrs["connect"], "", nil)
+		xtra = append(xtra, c.RemoteAddr().String())
+	}
+	if pc != nil {
+		xtra = append(xtra, pc.String())
 	}
+	s.lgenMsg(st.ln, cn, reqid, perrs["connect"], strings.Join(xtra, " "), nil)
 
 	for {
 		// read the request
-		req, perr, xtra, err := connRead(c, s.t, s.rl, s.hk, &reqid)
+		req, perr, xtra, err := connRead(bc, s.t, s.rl, sl, &reqid, &kid, nil)
 		if perr != "" {
-			s.genMsg(cn, reqid, perrs[perr], xtra, err)
+			// cancel and wait on any in-flight requests
+			// before reporting, so that their Msgs arrive
+			// first
+			cf()
+			rw.Wait()
+			s.lgenMsg(st.ln, cn, reqid, perrs[perr], xtra, err)
 			if perrs[perr].xmit != nil {
-				perr, err = connWrite(c, perrs[perr].xmit, s.hk, s.t, reqid)
+				perr, err = connWrite(c, perrs[perr].frame(perr, ""), sl, s.t, reqid)
 				if err != nil {
-					s.genMsg(cn, reqid, perrs[perr], "", err)
+					s.lgenMsg(st.ln, cn, reqid, perrs[perr], "", err)
 					return
 				}
 			}
 			return
 		}
-		if len(req) == 0 {
-			s.genMsg(cn, reqid, perrs["nilreq"], "", nil)
-			perr, err = connWrite(c, perrs["nilreq"].xmit, s.hk, s.t, reqid)
-			if err != nil {
-				s.genMsg(cn, reqid, perrs[perr], "", err)
+		if !s.begin(st) {
+			// we're shutting down and have said goodbye,
+			// so ignore anything else the client sends
+			// until it hangs up
+			continue
+		}
+		// work out who the client is, then enforce rate limits
+		if !idk {
+			tid, idk = connIdentity(c), true
+		}
+		id := tid
+		if kid != "" {
+			id = kid
+		}
+		if lim, wait := s.rateCheck(cb, key, id); lim != "" {
+			ok := s.rateLimited(st, cn, reqid, lim, wait)
+			s.end(st, cn)
+			if !ok {
 				return
 			}
 			continue
 		}
-
-		// dispatch the request and get the response
-		response, perr, xtra, err := s.reqDispatch(c, cn, reqid, req)
-		if perr != "" {
-			s.genMsg(cn, reqid, perrs[perr], xtra, err)
-			if perrs[perr].xmit != nil {
-				perr, err = connWrite(c, perrs[perr].xmit, s.hk, s.t, reqid)
-				if err != nil {
-					s.genMsg(cn, reqid, perrs[perr], "", err)
-					return
-				}
+		if sem == nil {
+			// no pipelining; handle the request inline
+			ok := s.reqServe(ctx, st, cn, reqid, req, id)
+			s.end(st, cn)
+			if !ok {
+				return
 			}
 			continue
 		}
+		// pipelining. wait for a slot, then hand the request
+		// off and go back to reading
+		sem <- true
+		rw.Add(1)
+		go func(reqid uint32, req []byte, id string) {
+			defer rw.Done()
+			if !s.reqServe(ctx, st, cn, reqid, req, id) {
+				// unblock the read loop so it can
+				// clean up
+				c.Close()
+			}
+			s.end(st, cn)
+			<-sem
+		}(reqid, req, id)
+	}
+}
+
+// bufConn is a connection which is read through a bufio.Reader.
+type bufConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (bc *bufConn) Read(p []byte) (int, error) { return bc.br.Read(p) }
+
+// watch calls cf if the client hangs up before the returned function
+// is called, which must be done before bc is read from again. It
+// peeks at the connection rather than reading from it, so anything
+// the client sends in the meantime is left for the next read. EOF
+// can't be told apart from a half-close, so that counts as hanging
+// up too.
+func (bc *bufConn) watch(cf context.CancelFunc) func() {
+	bc.SetReadDeadline(time.Time{})
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		_, err := bc.br.Peek(1)
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			cf()
+		}
+	}()
+	return func() {
+		// expire the read deadline to stop the Peek, if it's
+		// still waiting, then clear it again
+		bc.SetReadDeadline(time.Now())
+		<-done
+		bc.SetReadDeadline(time.Time{})
+	}
+}
+
+// connState tracks a connection.
+type connState struct {
+	c net.Conn
+	// name of the listener it arrived on
+	ln string
+	// peer credentials, for Unix conns
+	pc *PeerCred
+	// sealer, if transmissions are authenticated
+	sl sealer
+	// requests in flight
+	busy int
+	// goodbye sent
+	bye bool
+	// without pipelining, the conn to watch while a
+	// ContextResponder runs, and the cancel func for the
+	// connection's Context
+	bc *bufConn
+	cf context.CancelFunc
+}
+
+// conns maps connection ids to connStates.
+type conns map[uint32]*connState
+
+// track registers a connection, as busy. Once it is ready, it
+// should be given its sealer and marked idle with end, which tells
+// the client goodbye if the Server is shutting down.
+func (s *Server) track(c net.Conn, ln *srvListener, cn uint32, pc *PeerCred) *connState {
+	s.cm.Lock()
+	st := &connState{c: c, ln: ln.name, pc: pc, busy: 1}
+	s.cs[cn] = st
+	s.cm.Unlock()
+	return st
+}
+
+// untrack removes a connection registered by track.
+func (s *Server) untrack(cn uint32) {
+	s.cm.Lock()
+	delete(s.cs, cn)
+	s.cm.Unlock()
+}
+
+// begin marks a request as in flight on a connection. It returns
+// false if the client has been told goodbye, in which case the
+// request should be ignored.
+func (s *Server) begin(st *connState) bool {
+	s.cm.Lock()
+	defer s.cm.Unlock()
+	if st.bye {
+		return false
+	}
+	st.busy++
+	return true
+}
+
+// end marks a request as finished. If the Server is shutting down
+// and this was the connection's last request in flight, the client
+// is told goodbye.
+func (s *Server) end(st *connState, cn uint32) {
+	s.cm.Lock()
+	st.busy--
+	bye := s.dr && st.busy == 0 && !st.bye
+	st.bye = st.bye || bye
+	s.cm.Unlock()
+	if bye {
+		s.goodbye(st, cn)
+	}
+}
+
+// goodbye sends a client the notice that the Server is shutting
+// down, and closes our side of its connection. The client is
+// expected to hang up in turn, which ends connServer normally.
+func (s *Server) goodbye(st *connState, cn uint32) {
+	s.lgenMsg(st.ln, cn, 0, perrs["goodbye"], "", nil)
+	connWrite(st.c, perrs["goodbye"].frame("goodbye", ""), st.sl, s.t, 0)
+	if cw, ok := st.c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// rateCheck takes a token from each of the rate limit buckets which
+// apply to a request. If any of them is empty, it returns the name of
+// that limit and how long until it will have a token again.
+func (s *Server) rateCheck(cb *bucket, key, id string) (string, time.Duration) {
+	if ok, wait := cb.take(); !ok {
+		return "connection", wait
+	}
+	if ok, wait := s.irl.take(key); !ok {
+		return "address", wait
+	}
+	if ok, wait := s.drl.take(id); !ok {
+		return "identity", wait
+	}
+	return "", 0
+}
+
+// rateLimited reports and answers a request which has been refused
+// by rateCheck. It returns false if the connection should be closed.
+func (s *Server) rateLimited(st *connState, cn, reqid uint32, lim string, wait time.Duration) bool {
+	s.lgenMsg(st.ln, cn, reqid, perrs["ratelimit"], lim, nil)
+	// the hint is sent as a number of milliseconds, rounded up
+	ms := strconv.FormatInt(int64((wait+time.Millisecond-1)/time.Millisecond), 10)
+	perr, err := connWrite(st.c, perrs["ratelimit"].frame("ratelimit", ms), st.sl, s.t, reqid)
+	if err != nil {
+		s.lgenMsg(st.ln, cn, reqid, perrs[perr], "", err)
+		return false
+	}
+	return true
+}
+
+// connIdentity returns the TLS identity of a client: the subject of
+// its certificate. It returns "" for clients which have not presented
+// a certificate.
+func connIdentity(c net.Conn) string {
+	if tc, ok := c.(*tls.Conn); ok {
+		if cs := tc.ConnectionState(); len(cs.PeerCertificates) > 0 {
+			return cs.PeerCertificates[0].Subject.String()
+		}
+	}
+	return ""
+}
 
-		// send response
-		perr, err = connWrite(c, response, s.hk, s.t, reqid)
+// reqServe dispatches a single request and sends its response. 'id'
+// is the client's identity. It returns false if the connection
+// should be closed.
+func (s *Server) reqServe(ctx context.Context, st *connState, cn, reqid uint32, req []byte, id string) bool {
+	if len(req) == 0 {
+		s.lgenMsg(st.ln, cn, reqid, perrs["nilreq"], "", nil)
+		perr, err := connWrite(st.c, perrs["nilreq"].frame("nilreq", ""), st.sl, s.t, reqid)
 		if err != nil {
-			s.genMsg(cn, reqid, perrs[perr], "", err)
-			return
+			s.lgenMsg(st.ln, cn, reqid, perrs[perr], "", err)
+			return false
 		}
-		s.genMsg(cn, reqid, perrs["success"], "", nil)
+		return true
+	}
+
+	// dispatch the request and get the response
+	response, perr, xtra, err := s.reqDispatch(ctx, st, cn, reqid, req, id)
+	if perr != "" {
+		p, kind, msg := perrs[perr], perr, ""
+		var ae *AppErr
+		switch {
+		case perr == "reqerr" && errors.As(err, &ae) && ae.valid():
+			// the Responder has given us an application
+			// status to pass along
+			p, kind, msg, xtra, err = ae.perr(), "apperr", ae.Txt, ae.Txt, nil
+		case perr == "reqerr" && !s.re:
+			// pass along the Responder's error text,
+			// unless we've been told not to
+			msg = err.Error()
+		}
+		s.lgenMsg(st.ln, cn, reqid, p, xtra, err)
+		if p.xmit != nil {
+			perr, err = connWrite(st.c, p.frame(kind, msg), st.sl, s.t, reqid)
+			if err != nil {
+				s.lgenMsg(st.ln, cn, reqid, perrs[perr], "", err)
+				return false
+			}
+		}
+		// optionally, drop connections whose requests cause
+		// panics
+		return !(kind == "reqpanic" && s.pc)
+	}
+
+	// send response
+	perr, err = connWrite(st.c, response, st.sl, s.t, reqid)
+	if err != nil {
+		s.lgenMsg(st.ln, cn, reqid, perrs[perr], "", err)
+		return false
 	}
+	s.lgenMsg(st.ln, cn, reqid, perrs["success"], "", nil)
+	return true
 }
 
 // reqDispatch turns the request into a command and arguments, and
 // dispatches these components to a handler.
-func (s *Server) reqDispatch(c net.Conn, cn, reqid uint32, req []byte) ([]byte, string, string, error) {
+func (s *Server) reqDispatch(ctx context.Context, st *connState, cn, reqid uint32, req []byte, id string) ([]byte, string, string, error) {
 	// get chunk locations
 	cl := qsplit.LocationsOnce(req)
 	dcmd := string(req[cl[0]:cl[1]])
@@ -111,7 +495,7 @@ func (s *Server) reqDispatch(c net.Conn, cn, reqid uint32, req []byte) ([]byte,
 		dargs = req[cl[2]:]
 	}
 	// send error if we don't recognize the command
-	responder, ok := s.d[dcmd]
+	responder, ok := s.lookup(dcmd)
 	if !ok {
 		return nil, "badreq", dcmd, nil
 	}
@@ -125,10 +509,168 @@ func (s *Server) reqDispatch(c net.Conn, cn, reqid uint32, req []byte) ([]byte,
 		rs = rs[:0]
 		rs = append(rs, dargs)
 	}
-	s.genMsg(cn, reqid, perrs["dispatch"], dcmd, nil)
-	response, err := responder.r(rs)
-	if err != nil {
+	ri := &ReqInfo{Conn: cn, Req: reqid, Cmd: dcmd, Addr: st.c.RemoteAddr(), Listener: st.ln, Peer: st.pc, Identity: id, dl: s.rt, s: s}
+	if tc, ok := st.c.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		ri.TLS = &cs
+	}
+	// wait for a slot, if there is a limit on dispatches
+	if err := s.lim.acquire(ctx); err == errBusy {
+		return nil, "busy", dcmd, nil
+	} else if err != nil {
 		return nil, "reqerr", "", err
 	}
-	return response, "", "", nil
+	defer ri.release(s.lim.release)
+	s.lgenMsg(st.ln, cn, reqid, perrs["dispatch"], dcmd, nil)
+	if st.bc != nil && responder.cx {
+		// nothing else is reading the conn, so watch it
+		// for the client hanging up
+		defer st.bc.watch(st.cf)()
+	}
+	response, perr, err := callResponder(ctx, responder.r, ri, rs)
+	switch perr {
+	case "":
+		return response, "", "", nil
+	case "busy":
+		return nil, perr, dcmd, nil
+	case "reqpanic":
+		return nil, perr, dcmd, err
+	case "reqtimeout":
+		return nil, perr, fmt.Sprintf("%s after %v", dcmd, err.(*deadlineErr).el), err
+	}
+	return nil, perr, "", err
+}
+
+// callResponder calls a Responder, recovering from any panic it
+// raises. The panic value and stack trace are returned as the error.
+func callResponder(ctx context.Context, r ContextResponder, ri *ReqInfo, rs [][]byte) (resp []byte, perr string, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			stack := debug.Stack()
+			if rp, ok := x.(*respPanic); ok {
+				// this came from a deadlined Responder
+				x, stack = rp.x, rp.stack
+			}
+			resp, perr, err = nil, "reqpanic", fmt.Errorf("panic: %v\n%s", x, stack)
+		}
+	}()
+	resp, err = r(ctx, ri, rs)
+	var de *deadlineErr
+	if errors.As(err, &de) {
+		perr, err = "reqtimeout", de
+	} else if err == errBusy {
+		perr = "busy"
+	} else if err != nil {
+		perr = "reqerr"
+	}
+	return resp, perr, err
+}
+
+// deadlineErr is returned when a Responder runs past its deadline.
+type deadlineErr struct {
+	el time.Duration
+}
+
+func (e *deadlineErr) Error() string {
+	return fmt.Sprintf("deadline exceeded after %v", e.el)
+}
+
+// release calls f once the request's Responder has returned. That is
+// right away, unless deadlined gave up on the Responder, in which
+// case it is whenever the Responder finishes.
+func (ri *ReqInfo) release(f func()) {
+	if ri.rd == nil {
+		f()
+		return
+	}
+	select {
+	case <-ri.rd:
+		f()
+	default:
+		go func() {
+			<-ri.rd
+			f()
+		}()
+	}
+}
+
+// respPanic carries a panic out of the goroutine which runs a
+// deadlined Responder, so it can be reported with the right stack.
+type respPanic struct {
+	x     interface{}
+	stack []byte
+}
+
+// deadlined wraps a ContextResponder so that it runs under the
+// deadline in its ReqInfo, if there is one. When the deadline
+// passes, the Responder's Context is cancelled and a deadlineErr is
+// returned immediately; the Responder itself is left to finish in
+// the background, and anything it holds should be let go of with
+// ReqInfo.release. The Server waits for it before Quit or Shutdown
+// return, and reports it if it panics.
+func deadlined(r ContextResponder) ContextResponder {
+	return func(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+		if ri.dl <= 0 {
+			return r(ctx, ri, args)
+		}
+		start := time.Now()
+		ctx, cf := context.WithTimeout(ctx, ri.dl)
+		defer cf()
+		type result struct {
+			resp []byte
+			err  error
+			p    *respPanic
+		}
+		// rc is unbuffered, so that the result is either taken
+		// or, once gone is closed, known to have been abandoned
+		rc := make(chan result)
+		gone := make(chan bool)
+		ri.rd = make(chan bool)
+		ri.s.w.Add(1)
+		go func() {
+			defer ri.s.w.Done()
+			defer close(ri.rd)
+			var res result
+			defer func() {
+				if x := recover(); x != nil {
+					res = result{p: &respPanic{x, debug.Stack()}}
+				}
+				select {
+				case rc <- res:
+				case <-gone:
+					// nobody is waiting to hear about
+					// a panic now, so report it here
+					if res.p != nil {
+						err := fmt.Errorf("panic: %v\n%s", res.p.x, res.p.stack)
+						ri.s.lgenMsg(ri.Listener, ri.Conn, ri.Req, perrs["reqpanic"], ri.Cmd+" after deadline", err)
+					}
+				}
+			}()
+			res.resp, res.err = r(ctx, ri, args)
+		}()
+		var res result
+		select {
+		case res = <-rc:
+			<-ri.rd
+		case <-ctx.Done():
+			if ctx.Err() != context.DeadlineExceeded {
+				// cancelled for some other reason; let
+				// the Responder decide what to do about
+				// it
+				res = <-rc
+				<-ri.rd
+			} else {
+				close(gone)
+			}
+		}
+		if res.p != nil {
+			panic(res.p)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			// whatever the Responder may have had to say,
+			// it was too late
+			return nil, &deadlineErr{time.Since(start)}
+		}
+		return res.resp, res.err
+	}
 }
@@ -0,0 +1,183 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// Unix domain socket management for petrel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// staleProbe is how long UnixClean waits when checking whether a
+// socket is in use.
+var staleProbe = 100 * time.Millisecond
+
+// unixListen creates the listener for a UnixServer, with p as the
+// socket's permissions, applying the Unix options in c.
+func unixListen(c *ServerConfig, p uint32) (*net.UnixListener, error) {
+	if err := abstractCheck(c.Sockname); err != nil {
+		return nil, err
+	}
+	if isAbstract(c.Sockname) {
+		// there's no file, so there's nothing to manage
+		return net.ListenUnix("unix", &net.UnixAddr{Name: c.Sockname, Net: "unix"})
+	}
+	if c.UnixDirPerm != 0 {
+		if err := os.MkdirAll(filepath.Dir(c.Sockname), os.FileMode(c.UnixDirPerm)); err != nil {
+			return nil, err
+		}
+	}
+	if c.UnixClean {
+		if err := clearStale(c.Sockname); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: c.Sockname, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket file is removed by the Server (see sockFile),
+	// not the listener
+	l.SetUnlinkOnClose(false)
+	if err = unixPerms(c, p); err != nil {
+		l.Close()
+		os.Remove(c.Sockname)
+		return nil, err
+	}
+	return l, nil
+}
+
+// unixPerms sets the permissions, and optionally the owner and
+// group, of a UnixServer's socket file.
+func unixPerms(c *ServerConfig, p uint32) error {
+	if err := os.Chmod(c.Sockname, os.FileMode(p)); err != nil {
+		return err
+	}
+	if c.UnixOwner == "" && c.UnixGroup == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if c.UnixOwner != "" {
+		id, err := lookupID(c.UnixOwner, func(n string) (string, error) {
+			u, err := user.Lookup(n)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = id
+	}
+	if c.UnixGroup != "" {
+		id, err := lookupID(c.UnixGroup, func(n string) (string, error) {
+			g, err := user.LookupGroup(n)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = id
+	}
+	return os.Chown(c.Sockname, uid, gid)
+}
+
+// lookupID turns a user or group name into a numeric id, using
+// 'lookup'. Names which are already numeric are used as-is.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	sid, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(sid)
+}
+
+// clearStale removes the socket file at 'path' if nothing is
+// listening on it.
+func clearStale(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	c, err := net.DialTimeout("unix", path, staleProbe)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("can't tell if %s is in use: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// isAbstract reports whether a Unix socket address is in the Linux
+// abstract namespace, rather than the filesystem. Such addresses
+// start with "@".
+func isAbstract(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
+// abstractCheck returns an error for abstract socket addresses on
+// platforms which don't support them.
+func abstractCheck(addr string) error {
+	if isAbstract(addr) && runtime.GOOS != "linux" {
+		return fmt.Errorf("abstract socket address '%s' is only supported on Linux", addr)
+	}
+	return nil
+}
+
+// sockFile is a Unix socket file which a Server removes when it
+// stops. A nil sockFile is left alone.
+type sockFile struct {
+	path string
+	fi   os.FileInfo
+}
+
+// newSockFile returns a sockFile for the socket at 'path', or nil if
+// c says to keep it.
+func newSockFile(c *ServerConfig, path string) *sockFile {
+	if c.UnixKeep || isAbstract(path) {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return &sockFile{path, fi}
+}
+
+// remove deletes the socket file, if it is still the one which was
+// there when the sockFile was made.
+func (sf *sockFile) remove() {
+	if sf == nil {
+		return
+	}
+	if fi, err := os.Stat(sf.path); err == nil && os.SameFile(fi, sf.fi) {
+		os.Remove(sf.path)
+	}
+}
@@ -5,6 +5,8 @@ package petrel
 // BSD-style license that can be found in the LICENSE file.
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -18,19 +20,45 @@ type Server struct {
 	// Msgr is the channel which receives notifications from
 	// connections.
 	Msgr chan *Msg
-	q    chan bool
 	w    *sync.WaitGroup
-	s    string        // socket name
-	l    net.Listener  // listener socket
-	d    dispatch      // dispatch table
-	t    time.Duration // timeout
-	rl   uint32        // request length
-	ml   int           // message level
-	li   bool          // log ip flag
-	hk   []byte        // HMAC key
+	ctx  context.Context    // cancelled by Quit
+	cf   context.CancelFunc // cancel func for ctx
+	s    string             // socket name
+	l    net.Listener       // listener socket
+	nl   net.Listener       // network listener (under TLS, if any)
+	d    dispatch           // dispatch table
+	dm   sync.RWMutex       // lock for d
+	t    time.Duration      // timeout
+	rl   uint32             // request length
+	pl   int                // per-conn in-flight request limit
+	ml   int                // message level
+	li   bool               // log ip flag
+	ns   newSealer          // sets up conn sealers
+	re   bool               // redact Responder errors
+	pc   bool               // close conns on Responder panic
+	ic   []Interceptor      // server-wide Interceptors
+	rt   time.Duration      // default Responder deadline
+	lim  *limiter           // server-wide dispatch limit
+	cl   *connLimiter       // connection admission control
+	m4   net.IPMask         // IPv4 grouping mask
+	m6   net.IPMask         // IPv6 grouping mask
+	crl  *RateLimit         // per-conn rate limit
+	irl  *bucketMap         // per-IP rate limits
+	drl  *bucketMap         // per-identity rate limits
+	cm   sync.Mutex         // lock for cs, dr, ls, qt, and us
+	cs   conns              // open connections
+	dr   bool               // draining (Shutdown called)
+	ls   []*srvListener     // all listeners
+	qt   bool               // quitting
+	cn   uint32             // last connection id
+	rn   int32              // refusals in progress
+	us   *sockFile          // Unix socket file to remove
+	pu   []uint32           // allowed Unix peer UIDs
+	pg   []uint32           // allowed Unix peer GIDs
 }
 
-// Register adds a Responder function to a Server.
+// Register adds a Responder function to a Server. It is safe to call
+// while the Server is handling requests.
 //
 // 'name' is the command you wish this function do be the responder
 // for.
@@ -41,20 +69,150 @@ type Server struct {
 // Responder as an ARGV style list, use 'argv'. 'argv', as might be
 // expected, has a higher overhead than 'blob'.
 //
-// 'r' is the name of the Responder function which will be called on dispatch.
-func (s *Server) Register(name string, mode string, r Responder) error {
+// 'r' is the function which will be called on dispatch. It must be
+// either a Responder or a ContextResponder.
+//
+// 'ic' are optional Interceptors which wrap 'r'. They run, in order,
+// inside any server-wide Interceptors (see ServerConfig).
+func (s *Server) Register(name string, mode string, r interface{}, ic ...Interceptor) error {
+	rs, err := newResponder(mode, r, ic)
+	if err != nil {
+		return err
+	}
+	s.dm.Lock()
+	defer s.dm.Unlock()
 	if _, ok := s.d[name]; ok {
 		return fmt.Errorf("handler '%v' already exists", name)
 	}
-	if mode != "argv" && mode != "blob" {
-		return fmt.Errorf("invalid mode '%v'", mode)
+	s.d[name] = s.wrap(rs)
+	return nil
+}
+
+// Replace swaps out the Responder for an existing command. Its
+// arguments are the same as Register's. Requests which are already
+// being handled by the old Responder are unaffected.
+func (s *Server) Replace(name string, mode string, r interface{}, ic ...Interceptor) error {
+	rs, err := newResponder(mode, r, ic)
+	if err != nil {
+		return err
+	}
+	s.dm.Lock()
+	defer s.dm.Unlock()
+	if _, ok := s.d[name]; !ok {
+		return fmt.Errorf("handler '%v' does not exist", name)
+	}
+	s.d[name] = s.wrap(rs)
+	return nil
+}
+
+// Unregister removes the Responder for a command. Requests which are
+// already being handled by it are unaffected; later requests for the
+// command get a "bad command" error.
+func (s *Server) Unregister(name string) error {
+	s.dm.Lock()
+	defer s.dm.Unlock()
+	if _, ok := s.d[name]; !ok {
+		return fmt.Errorf("handler '%v' does not exist", name)
+	}
+	delete(s.d, name)
+	return nil
+}
+
+// Swap replaces the Server's entire set of Responders with those in
+// t, in a single step.
+func (s *Server) Swap(t *DispatchTable) {
+	d := make(dispatch, len(t.d))
+	for name, rs := range t.d {
+		d[name] = s.wrap(rs)
+	}
+	s.dm.Lock()
+	s.d = d
+	s.dm.Unlock()
+}
+
+// DispatchTable is a set of Responders which can be built up ahead of
+// time and then installed all at once with Server.Swap. It is not
+// safe for concurrent use.
+type DispatchTable struct {
+	d dispatch
+}
+
+// NewDispatchTable returns an empty DispatchTable.
+func NewDispatchTable() *DispatchTable {
+	return &DispatchTable{make(dispatch)}
+}
+
+// Register adds a Responder to the DispatchTable. Its arguments are
+// the same as Server.Register's.
+func (t *DispatchTable) Register(name string, mode string, r interface{}, ic ...Interceptor) error {
+	if _, ok := t.d[name]; ok {
+		return fmt.Errorf("handler '%v' already exists", name)
+	}
+	rs, err := newResponder(mode, r, ic)
+	if err != nil {
+		return err
 	}
-	s.d[name] = &responder{r, mode}
+	t.d[name] = rs
 	return nil
 }
 
+// newResponder validates a Responder and its mode, and wraps it in
+// its Interceptors.
+func newResponder(mode string, r interface{}, ic []Interceptor) (*responder, error) {
+	if mode != "argv" && mode != "blob" {
+		return nil, fmt.Errorf("invalid mode '%v'", mode)
+	}
+	var cr ContextResponder
+	var cx bool
+	switch f := r.(type) {
+	case Responder:
+		cr = func(_ context.Context, _ *ReqInfo, args [][]byte) ([]byte, error) { return f(args) }
+	case func([][]byte) ([]byte, error):
+		cr = func(_ context.Context, _ *ReqInfo, args [][]byte) ([]byte, error) { return f(args) }
+	case ContextResponder:
+		cr, cx = f, true
+	case func(context.Context, *ReqInfo, [][]byte) ([]byte, error):
+		cr, cx = f, true
+	default:
+		return nil, fmt.Errorf("invalid responder type '%T'", r)
+	}
+	return &responder{intercept(deadlined(cr), ic), mode, cx}, nil
+}
+
+// wrap returns a copy of a responder wrapped in the Server's
+// Interceptors.
+func (s *Server) wrap(rs *responder) *responder {
+	return &responder{intercept(rs.r, s.ic), rs.mode, rs.cx}
+}
+
+// lookup returns the responder for a command, if there is one.
+func (s *Server) lookup(name string) (*responder, bool) {
+	s.dm.RLock()
+	defer s.dm.RUnlock()
+	rs, ok := s.d[name]
+	return rs, ok
+}
+
+// intercept wraps a ContextResponder in a chain of Interceptors, so
+// that ic[0] is outermost.
+func intercept(r ContextResponder, ic []Interceptor) ContextResponder {
+	for i := len(ic) - 1; i >= 0; i-- {
+		f, next := ic[i], r
+		r = func(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+			return f(ctx, ri, args, next)
+		}
+	}
+	return r
+}
+
 // genMsg creates messages and sends them to the Msgr channel.
 func (s *Server) genMsg(conn, req uint32, p *Perr, xtra string, err error) {
+	s.lgenMsg("", conn, req, p, xtra, err)
+}
+
+// lgenMsg is genMsg for messages about a connection or listener,
+// which carry the name of the listener.
+func (s *Server) lgenMsg(ln string, conn, req uint32, p *Perr, xtra string, err error) {
 	// if this message's level is below the instance's level, don't
 	// generate the message
 	if p.Lvl < s.ml {
@@ -64,20 +222,124 @@ func (s *Server) genMsg(conn, req uint32, p *Perr, xtra string, err error) {
 	if xtra != "" {
 		txt = fmt.Sprintf("%s: [%s]", txt, xtra)
 	}
-	s.Msgr <- &Msg{conn, req, p.Code, txt, err}
+	s.Msgr <- &Msg{Conn: conn, Req: req, Code: p.Code, Txt: txt, Err: err, Listener: ln}
+}
+
+// AddListener makes the Server accept connections from another
+// Listener, in addition to the one it was created with. Connections
+// from all listeners share the Server's Responders, configuration,
+// and Msgr. 'name' identifies the listener in Msgs and ReqInfos; if it
+// is empty, the Listener's address is used. A Server's first listener
+// is named for its Sockname.
+//
+// Listeners are closed by Quit and Shutdown.
+func (s *Server) AddListener(name string, l net.Listener) error {
+	if name == "" {
+		name = l.Addr().String()
+	}
+	s.cm.Lock()
+	defer s.cm.Unlock()
+	if s.qt {
+		return fmt.Errorf("server is shutting down")
+	}
+	for _, ln := range s.ls {
+		if ln.name == name {
+			return fmt.Errorf("listener '%s' already exists", name)
+		}
+	}
+	ln := &srvListener{name, l}
+	s.ls = append(s.ls, ln)
+	s.w.Add(1)
+	go s.sockAccept(ln)
+	return nil
+}
+
+// stop marks the Server as quitting, and closes its listeners.
+func (s *Server) stop() {
+	s.cm.Lock()
+	s.qt = true
+	ls := s.ls
+	s.cm.Unlock()
+	for _, ln := range ls {
+		ln.l.Close()
+	}
+	s.cm.Lock()
+	s.us.remove()
+	s.cm.Unlock()
+}
+
+// stopping reports whether stop has been called.
+func (s *Server) stopping() bool {
+	s.cm.Lock()
+	defer s.cm.Unlock()
+	return s.qt
 }
 
 // Quit handles shutdown and cleanup, including waiting for any
 // connections to terminate. When it returns, all connections are
 // fully shut down and no more work will be done.
+//
+// Quit waits on connections for as long as their clients keep them
+// open. Use Shutdown to close them down on the Server's own
+// schedule.
 func (s *Server) Quit() {
-	s.q <- true
-	s.l.Close()
+	s.cf()
+	s.stop()
 	s.w.Wait()
-	close(s.q)
 	close(s.Msgr)
 }
 
+// Shutdown stops the Server gracefully. It closes the listeners, lets
+// requests which are already being handled finish, and sends each
+// client a "goodbye" notice (status 195) once its connection is idle,
+// so that it disconnects cleanly. If ctx is done before all
+// connections have closed, the rest are closed forcibly, the
+// Contexts of any Responders still running are cancelled, and ctx's
+// error is returned. Shutdown still waits for those Responders to
+// return.
+//
+// When Shutdown returns, no more work will be done. Call either
+// Shutdown or Quit, and only once.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	// say goodbye to idle conns. busy ones will be told when
+	// they finish
+	s.cm.Lock()
+	s.dr = true
+	bye := conns{}
+	for cn, st := range s.cs {
+		if st.busy == 0 && !st.bye {
+			st.bye = true
+			bye[cn] = st
+		}
+	}
+	s.cm.Unlock()
+	for cn, st := range bye {
+		s.goodbye(st, cn)
+	}
+	done := make(chan bool)
+	go func() {
+		s.w.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.cf()
+		s.cm.Lock()
+		for _, st := range s.cs {
+			st.c.Close()
+		}
+		s.cm.Unlock()
+		<-done
+	}
+	s.cf()
+	close(s.Msgr)
+	return err
+}
+
 // Msg is the format which Petrel uses to communicate informational
 // messages and errors to its host program via the s.Msgr channel.
 type Msg struct {
@@ -91,6 +353,9 @@ type Msg struct {
 	Txt string
 	// Err is the error (if any) passed upward as part of the Msg.
 	Err error
+	// Listener is the name of the listener which the connection
+	// arrived on (see Server.AddListener).
+	Listener string
 }
 
 // Error implements the error interface for Msg, returning a nicely
@@ -122,6 +387,18 @@ type ServerConfig struct {
 	// file descriptors for new conns).
 	Timeout int64
 
+	// ReqTimeout is the number of milliseconds a Responder may
+	// run before the request is failed with a timeout error
+	// (status 504). The Responder's Context is cancelled at the
+	// deadline, but since goroutines cannot be stopped from
+	// outside, a Responder which ignores its Context will run to
+	// completion in the background, keeping its MaxDispatch or
+	// Limit slot until it does. Quit and Shutdown wait for it,
+	// and any panic it raises is reported via Msgr. Individual
+	// commands may set their own deadlines with the Deadline
+	// Interceptor. Default (zero) is no deadline.
+	ReqTimeout int64
+
 	// Reqlen is the maximum number of bytes in a single read from
 	// the network. If a request exceeds this limit, the
 	// connection will be dropped. Use this to prevent memory
@@ -129,6 +406,107 @@ type ServerConfig struct {
 	// (0) is unlimited.
 	Reqlen uint32
 
+	// Inflight is the maximum number of requests from a single
+	// connection which will be dispatched concurrently. When it
+	// is greater than 1, the Server keeps reading requests while
+	// earlier ones are being handled, and responses are sent as
+	// they complete -- possibly out of order. Clients match
+	// responses to requests by sequence number. The default (0
+	// or 1) handles each connection's requests one at a time.
+	Inflight int
+
+	// MaxDispatch is the maximum number of requests, across all
+	// connections, which will be dispatched concurrently. Requests
+	// beyond this wait for a slot, up to MaxQueue of them; any
+	// more are refused with a "server busy" error (status 503).
+	// There is no per-command setting here; to cap a single
+	// command, pass a Limit Interceptor to Register along with
+	// it. Both caps apply to such commands. Default (zero) is
+	// unlimited.
+	MaxDispatch int
+
+	// MaxQueue is the number of requests which may wait for a
+	// dispatch slot when MaxDispatch is set. Default (zero) is no
+	// waiting: requests are refused as soon as all slots are
+	// full.
+	MaxQueue int
+
+	// MaxConns is the maximum number of open client
+	// connections. Connections beyond this are sent a "connection
+	// refused" error (status 403) and closed. Clients get a
+	// second to take delivery of the notice, and if many are
+	// being refused at once, the rest are closed without
+	// one. Default (zero) is unlimited.
+	MaxConns int
+
+	// MaxConnsPerIP is the maximum number of open connections
+	// from a single remote address (or network; see IPv4Prefix
+	// and IPv6Prefix). It has no effect on Unix domain sockets.
+	// Default (zero) is unlimited.
+	MaxConnsPerIP int
+
+	// IPv4Prefix and IPv6Prefix are the prefix lengths used to
+	// group client addresses for per-IP limits. For instance,
+	// with an IPv6Prefix of 64, all clients in a /64 network
+	// count as one. Defaults are 32 and 128 (single addresses).
+	IPv4Prefix int
+	IPv6Prefix int
+
+	// AcceptRate is the number of new connections per second
+	// which will be accepted, averaged over bursts of up to
+	// AcceptBurst connections. Connections beyond this are
+	// refused. Default (zero) is unlimited.
+	AcceptRate int
+
+	// AcceptBurst is the largest burst of connections allowed
+	// by AcceptRate. Defaults to AcceptRate.
+	AcceptBurst int
+
+	// ConnRate, IPRate, and IdentityRate set token-bucket rate
+	// limits on requests: per connection, per remote address
+	// (grouped as for MaxConnsPerIP), and per authenticated
+	// client identity (see ReqInfo.Identity). Requests beyond a limit are refused with a
+	// "rate limited" error (status 429) which tells the client
+	// how long to wait before trying again. Default (nil) is no
+	// limit.
+	ConnRate     *RateLimit
+	IPRate       *RateLimit
+	IdentityRate *RateLimit
+
+	// UnixClean makes UnixServer deal with a socket file left
+	// behind by a process which did not shut down cleanly. If the
+	// file exists, UnixServer tries to connect to it; if nothing
+	// is listening, the file is removed. Files which are not
+	// sockets, and sockets which are in use, are never removed.
+	UnixClean bool
+
+	// UnixOwner and UnixGroup set the owner and group of a
+	// UnixServer's socket file. Each may be a name or a numeric
+	// id. Defaults ("") leave them as created.
+	UnixOwner string
+	UnixGroup string
+
+	// UnixDirPerm, if set, makes UnixServer create any missing
+	// parent directories of the socket file, with these Unix
+	// permissions (e.g. 0750). Default (zero) is to create none.
+	UnixDirPerm uint32
+
+	// PeerUIDs and PeerGIDs restrict which processes may connect
+	// over Unix domain sockets. If either is set, a client is
+	// accepted only if its peer credentials match one of the
+	// listed UIDs or GIDs; others are sent a "peer credentials
+	// rejected" notice (status 405) and disconnected before any
+	// request is read. Peer credentials are supported only on
+	// Linux; elsewhere, setting these rejects all Unix
+	// clients. Connections over TCP are not affected.
+	PeerUIDs []uint32
+	PeerGIDs []uint32
+
+	// UnixKeep leaves a Unix Server's socket file in place when
+	// it stops. By default the file is removed by Quit and
+	// Shutdown (if it is still the one the Server created).
+	UnixKeep bool
+
 	// Buffer sets how many instances of Msg may be queued in
 	// Server.Msgr. Non-Fatal Msgs which arrive while the buffer
 	// is full are dropped on the floor to prevent the Server from
@@ -154,25 +532,152 @@ type ServerConfig struct {
 	//overhead for each message sent and received, so use this
 	//when security outweighs performance.
 	HMACKey []byte
+
+	// Keyring holds HMAC keys, identified by number, which are
+	// used instead of HMACKey to sign and verify messages (see
+	// Keyring). Clients must also use a Keyring. The key ID of
+	// each request is passed to Responders in ReqInfo.Identity.
+	Keyring *Keyring
+
+	// ReplayWindow turns on replay protection for transmissions
+	// authenticated by HMACKey or Keyring. Each transmission
+	// carries a timestamp and a random nonce, and its MAC covers
+	// the whole header as well as the payload. Transmissions
+	// whose timestamps are more than ReplayWindow milliseconds
+	// away from the Server's clock, or whose nonces have been
+	// seen before, are refused with status 406 ("replay"), and
+	// the connection is closed. Clients must also set
+	// ReplayWindow. Default (zero) is off.
+	ReplayWindow int64
+
+	// SignKey and ClientKeys turn on Ed25519 message signing, in
+	// place of HMAC. The Server signs its responses with
+	// SignKey, and accepts only requests signed by the private
+	// halves of ClientKeys; others are refused as for bad MACs
+	// (status 502), and the connection is closed. Clients set
+	// ServerKey to the public half of SignKey. Unlike with a
+	// shared HMAC key, Clients can't impersonate the Server or
+	// each other. Requests are passed to Responders with
+	// ReqInfo.Identity set as by Ed25519Identity.
+	SignKey    ed25519.PrivateKey
+	ClientKeys []ed25519.PublicKey
+
+	// PSK is a pre-shared secret which turns on encryption, for
+	// confidentiality without TLS certificates. Each connection
+	// begins with a handshake, from which the Server and Client
+	// derive keys for that connection alone; transmissions are
+	// then encrypted and authenticated with AES-256-GCM. Requests
+	// which fail to decrypt are refused as for bad MACs (status
+	// 502), and the connection is closed. Clients which don't
+	// finish the handshake within Timeout (or 10 seconds, if
+	// Timeout is 0) are dropped. Clients must use the same PSK,
+	// which should be at least 32 random bytes. PSK takes
+	// precedence over the other authentication options.
+	PSK []byte
+
+	// RedactErrs controls whether the text of errors returned by
+	// Responders is sent to clients. By default it is, as part of
+	// the error response. If RedactErrs is true, clients receive
+	// only the status code and kind ("reqerr"). The full error is
+	// reported via Msgr either way.
+	RedactErrs bool
+
+	// PanicClose controls what happens when a Responder
+	// panics. The panic is always recovered, reported via Msgr
+	// (with a stack trace), and answered with an error response.
+	// By default the connection then carries on; if PanicClose is
+	// true, it is closed.
+	PanicClose bool
+
+	// Interceptors are wrapped around every Responder, in order
+	// (the first is outermost), when it is registered.
+	Interceptors []Interceptor
 }
 
-// Responder is the type which functions passed to Server.Register
-// must match: taking a slice of slices of bytes as an argument and
-// returning a slice of bytes and an error.
+// Responder is the basic type of function which may be passed to
+// Server.Register: taking a slice of slices of bytes as an argument
+// and returning a slice of bytes and an error.
 type Responder func([][]byte) ([]byte, error)
 
+// ContextResponder is the alternate type of function which may be
+// passed to Server.Register. In addition to the request arguments, it
+// receives a Context and a ReqInfo describing the request being
+// handled. The Context is cancelled when the client disconnects or
+// when Server.Quit is called. A client which closes its side of the
+// connection for writing (a half-close) is taken to have hung up.
+type ContextResponder func(context.Context, *ReqInfo, [][]byte) ([]byte, error)
+
+// Interceptor is a function which wraps the dispatch of requests to
+// a Responder. It receives the same arguments as a ContextResponder,
+// plus 'next', which continues the chain toward the Responder. An
+// Interceptor may inspect or alter the request before calling next,
+// return an error without calling next at all, alter the response
+// which next returns, or time the call.
+type Interceptor func(ctx context.Context, ri *ReqInfo, args [][]byte, next ContextResponder) ([]byte, error)
+
+// ReqInfo holds per-request metadata which is handed to
+// ContextResponders.
+type ReqInfo struct {
+	// Conn is the connection ID the request arrived on.
+	Conn uint32
+	// Req is the sequence number of the request.
+	Req uint32
+	// Cmd is the command being dispatched.
+	Cmd string
+	// Addr is the remote address of the client.
+	Addr net.Addr
+	// Listener is the name of the listener which the connection
+	// arrived on (see Server.AddListener).
+	Listener string
+	// TLS is the state of the connection, for TLS Servers. It is
+	// nil otherwise.
+	TLS *tls.ConnectionState
+	// Peer holds the credentials of the client process, for
+	// connections over Unix domain sockets on platforms which
+	// support it. It is nil otherwise.
+	Peer *PeerCred
+	// Identity is the authenticated identity of the client. For
+	// requests signed with a Keyring, it is "hmac:" followed by
+	// the key ID; otherwise, for TLS clients with certificates,
+	// it is the certificate subject. It is "" if neither applies.
+	Identity string
+	// execution deadline
+	dl time.Duration
+	// closed when the Responder returns, if deadlined is running
+	// it in the background
+	rd chan bool
+	// the Server handling the request, which waits on Responders
+	// left running past their deadlines
+	s *Server
+}
+
+// Deadline returns an Interceptor which sets the execution deadline,
+// in milliseconds, for a command. Pass it to Register to override
+// ServerConfig.ReqTimeout for that command; zero means no deadline.
+func Deadline(ms int64) Interceptor {
+	return func(ctx context.Context, ri *ReqInfo, args [][]byte, next ContextResponder) ([]byte, error) {
+		ri.dl = time.Duration(ms) * time.Millisecond
+		return next(ctx, ri, args)
+	}
+}
+
 // This is our dispatch table
 type dispatch map[string]*responder
 
 // ...and this is how we store Responders and their modes in the
-// dispatch table.
+// dispatch table. Plain Responders are wrapped so that everything
+// in the table is a ContextResponder.
 type responder struct {
-	r    Responder
+	r    ContextResponder
 	mode string
+	cx   bool // the Responder was a ContextResponder
 }
 
 // TCPServer returns a Server which uses TCP networking.
 func TCPServer(c *ServerConfig) (*Server, error) {
+	if err := c.keyCheck(); err != nil {
+		return nil, err
+	}
 	tcpaddr, err := net.ResolveTCPAddr("tcp", c.Sockname)
 	l, err := net.ListenTCP("tcp", tcpaddr)
 	if err != nil {
@@ -183,27 +688,120 @@ func TCPServer(c *ServerConfig) (*Server, error) {
 
 // TLSServer returns a Server which uses TCP networking, secured with TLS.
 func TLSServer(c *ServerConfig, t *tls.Config) (*Server, error) {
-	l, err := tls.Listen("tcp", c.Sockname, t)
+	if err := c.keyCheck(); err != nil {
+		return nil, err
+	}
+	if err := tlsCheck(t); err != nil {
+		return nil, err
+	}
+	nl, err := net.Listen("tcp", c.Sockname)
 	if err != nil {
 		return nil, err
 	}
-	return commonNew(c, l), nil
+	s := commonNew(c, tls.NewListener(nl, t))
+	s.nl = nl
+	return s, nil
+}
+
+// tlsCheck makes sure a tls.Config can be used by a server, as
+// tls.Listen would.
+func tlsCheck(t *tls.Config) error {
+	if t == nil || (len(t.Certificates) == 0 && t.GetCertificate == nil && t.GetConfigForClient == nil) {
+		return fmt.Errorf("tls: neither Certificates, GetCertificate, nor GetConfigForClient set in Config")
+	}
+	return nil
 }
 
 // UnixServer returns a Server which uses Unix domain sockets. Argument `p`
 // is the Unix permissions to set on the socket (e.g. 770)
+//
+// By default the socket file is removed when the Server stops; see
+// ServerConfig for this and other options for managing it.
+//
+// On Linux, a Sockname starting with "@" is an address in the
+// abstract namespace, which has no file: 'p' and the socket file
+// options are ignored. Since filesystem permissions don't apply to
+// abstract sockets, use PeerUIDs and PeerGIDs to control access.
 func UnixServer(c *ServerConfig, p uint32) (*Server, error) {
-	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: c.Sockname, Net: "unix"})
-	if err != nil {
+	if err := c.keyCheck(); err != nil {
 		return nil, err
 	}
-	err = os.Chmod(c.Sockname, os.FileMode(p))
+	l, err := unixListen(c, p)
 	if err != nil {
 		return nil, err
 	}
+	s := commonNew(c, l)
+	s.us = newSockFile(c, c.Sockname)
+	return s, nil
+}
+
+// NewServer returns a Server which accepts connections from an
+// existing Listener -- for instance, one wrapped by tls.NewListener,
+// or one built for testing. If c.Sockname is empty, it is set to the
+// Listener's address. Servers with listeners other than
+// *net.TCPListener and *net.UnixListener cannot use Handoff.
+func NewServer(c *ServerConfig, l net.Listener) (*Server, error) {
+	if err := c.keyCheck(); err != nil {
+		return nil, err
+	}
+	if l == nil {
+		return nil, fmt.Errorf("nil listener")
+	}
+	if c.Sockname == "" {
+		c.Sockname = l.Addr().String()
+	}
 	return commonNew(c, l), nil
 }
 
+// FileServer returns a Server which listens on an inherited socket,
+// such as one passed from a parent process by Server.Handoff. The
+// socket may be TCP or Unix; f is closed once the Server has its own
+// copy. If c.Sockname is empty, it is set to the socket's address.
+func FileServer(c *ServerConfig, f *os.File) (*Server, error) {
+	if err := c.keyCheck(); err != nil {
+		return nil, err
+	}
+	l, err := fileListener(c, f)
+	if err != nil {
+		return nil, err
+	}
+	s := commonNew(c, l)
+	if ul, ok := l.(*net.UnixListener); ok {
+		s.us = newSockFile(c, ul.Addr().String())
+	}
+	return s, nil
+}
+
+// TLSFileServer is FileServer for a TCP socket secured with TLS.
+func TLSFileServer(c *ServerConfig, f *os.File, t *tls.Config) (*Server, error) {
+	if err := c.keyCheck(); err != nil {
+		return nil, err
+	}
+	if err := tlsCheck(t); err != nil {
+		return nil, err
+	}
+	nl, err := fileListener(c, f)
+	if err != nil {
+		return nil, err
+	}
+	s := commonNew(c, tls.NewListener(nl, t))
+	s.nl = nl
+	return s, nil
+}
+
+// fileListener does the work of the file-based constructors.
+func fileListener(c *ServerConfig, f *os.File) (net.Listener, error) {
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	if c.Sockname == "" {
+		c.Sockname = l.Addr().String()
+	}
+	return l, nil
+}
+
 // commonNew does shared setup work for the constructors (mostly so
 // that changes to Server don't have to be mirrored)
 func commonNew(c *ServerConfig, l net.Listener) *Server {
@@ -215,17 +813,66 @@ func commonNew(c *ServerConfig, l net.Listener) *Server {
 		c.Buffer = 32
 	}
 	// create the Server, start listening, and return
-	s := &Server{make(chan *Msg, c.Buffer),
-		make(chan bool, 1),
-		&w,
-		c.Sockname,
-		l, make(dispatch),
-		time.Duration(c.Timeout) * time.Millisecond,
-		c.Reqlen,
-		c.Msglvl,
-		c.LogIP,
-		c.HMACKey,
-	}
-	go s.sockAccept()
+	ctx, cf := context.WithCancel(context.Background())
+	s := &Server{
+		Msgr: make(chan *Msg, c.Buffer),
+		w:    &w,
+		ctx:  ctx,
+		cf:   cf,
+		s:    c.Sockname,
+		l:    l,
+		nl:   l,
+		d:    make(dispatch),
+		t:    time.Duration(c.Timeout) * time.Millisecond,
+		rl:   c.Reqlen,
+		pl:   c.Inflight,
+		ml:   c.Msglvl,
+		li:   c.LogIP,
+		ns:   c.sealers(),
+		re:   c.RedactErrs,
+		pc:   c.PanicClose,
+		ic:   c.Interceptors,
+		rt:   time.Duration(c.ReqTimeout) * time.Millisecond,
+		lim:  newLimiter(c.MaxDispatch, c.MaxQueue),
+		cl:   newConnLimiter(c),
+		m4:   ipMask(c.IPv4Prefix, 32),
+		m6:   ipMask(c.IPv6Prefix, 128),
+		crl:  c.ConnRate,
+		irl:  newBucketMap(c.IPRate),
+		drl:  newBucketMap(c.IdentityRate),
+		cs:   conns{},
+		pu:   c.PeerUIDs,
+		pg:   c.PeerGIDs,
+	}
+	ln := &srvListener{c.Sockname, l}
+	s.ls = []*srvListener{ln}
+	go s.sockAccept(ln)
 	return s
 }
+
+// sealers returns the function which sets up the sealer for each of
+// a Server's connections.
+func (c *ServerConfig) sealers() newSealer {
+	var mk func() macKeys
+	switch {
+	case c.PSK != nil:
+		psk := c.PSK
+		return func(conn net.Conn) (sealer, error) { return pskAccept(conn, psk) }
+	case c.SignKey != nil:
+		ss := newSigSealer(c.SignKey, c.ClientKeys...)
+		return func(net.Conn) (sealer, error) { return ss, nil }
+	case c.Keyring != nil:
+		mk = func() macKeys { return &ringSealer{kr: c.Keyring, rp: true} }
+	case c.HMACKey != nil:
+		mk = func() macKeys { return hmacSealer(c.HMACKey) }
+	default:
+		return func(net.Conn) (sealer, error) { return nil, nil }
+	}
+	if c.ReplayWindow > 0 {
+		// nonces are remembered across connections, so
+		// that requests can't be replayed on a new one
+		nc := newNonceCache(c.ReplayWindow)
+		return func(net.Conn) (sealer, error) { return &replaySealer{mk(), nc}, nil }
+	}
+	return func(net.Conn) (sealer, error) { return mk(), nil }
+}
@@ -0,0 +1,112 @@
+package petrel
+
+// Copyright (c) 2020 Shawn Boyette <shawn@firepear.net>. All
+// rights reserved.  Use of this source code is governed by a
+// BSD-style license that can be found in the LICENSE file.
+
+// This file implements Ed25519 message signing.
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Ed25519Identity returns the identity which a Server reports (in
+// ReqInfo.Identity) for requests signed with the private half of
+// 'pub'.
+func Ed25519Identity(pub ed25519.PublicKey) string {
+	return "ed25519:" + hex.EncodeToString(keyPrint(pub))
+}
+
+// keyPrint returns the fingerprint of a public key: the first 8
+// bytes of its SHA-256 hash.
+func keyPrint(pub ed25519.PublicKey) []byte {
+	h := sha256.Sum256(pub)
+	return h[:8]
+}
+
+// sigSealer signs transmissions with an Ed25519 key, using protocol
+// version ProtoSigned. Its header fields are:
+//
+//	Key print       8 bytes
+//	Signature       64 bytes
+//
+// The key print identifies the signer's public key (see keyPrint),
+// and the signature covers the whole header up to itself, and the
+// payload.
+type sigSealer struct {
+	sk ed25519.PrivateKey
+	// fingerprint of sk's public key
+	kp []byte
+	// public keys which we accept signatures from, by
+	// fingerprint
+	pks map[string]ed25519.PublicKey
+}
+
+// keyCheck makes sure that a ServerConfig's Ed25519 keys, if it has
+// any, are usable.
+func (c *ServerConfig) keyCheck() error {
+	if c.PSK != nil || (c.SignKey == nil && c.ClientKeys == nil) {
+		return nil
+	}
+	if len(c.SignKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("SignKey is not a valid Ed25519 private key")
+	}
+	if len(c.ClientKeys) == 0 {
+		return fmt.Errorf("SignKey is set, but there are no ClientKeys")
+	}
+	for i, pk := range c.ClientKeys {
+		if len(pk) != ed25519.PublicKeySize {
+			return fmt.Errorf("ClientKeys[%d] is not a valid Ed25519 public key", i)
+		}
+	}
+	return nil
+}
+
+// keyCheck makes sure that a ClientConfig's Ed25519 keys, if it has
+// any, are usable.
+func (c *ClientConfig) keyCheck() error {
+	if c.PSK != nil || (c.SignKey == nil && c.ServerKey == nil) {
+		return nil
+	}
+	if len(c.SignKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("SignKey is not a valid Ed25519 private key")
+	}
+	if len(c.ServerKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("ServerKey is not a valid Ed25519 public key")
+	}
+	return nil
+}
+
+// newSigSealer returns a sigSealer which signs with 'sk' and accepts
+// signatures made by any of 'pks'. The keys must have been checked
+// by keyCheck.
+func newSigSealer(sk ed25519.PrivateKey, pks ...ed25519.PublicKey) *sigSealer {
+	ss := &sigSealer{sk: sk, pks: map[string]ed25519.PublicKey{}}
+	ss.kp = keyPrint(sk.Public().(ed25519.PublicKey))
+	for _, pk := range pks {
+		ss.pks[string(keyPrint(pk))] = pk
+	}
+	return ss
+}
+
+func (ss *sigSealer) ver() uint8 { return ProtoSigned }
+func (ss *sigSealer) hlen() int  { return 72 }
+
+func (ss *sigSealer) seal(seq uint32, payload []byte) ([]byte, error) {
+	xmission := xheader(seq, uint32(len(payload)), ProtoSigned)
+	xmission = append(xmission, ss.kp...)
+	sig := ed25519.Sign(ss.sk, append(xmission[:17:17], payload...))
+	xmission = append(xmission, sig...)
+	return append(xmission, payload...), nil
+}
+
+func (ss *sigSealer) open(hdr, body []byte) ([]byte, string, string) {
+	pk, ok := ss.pks[string(hdr[9:17])]
+	if !ok || !ed25519.Verify(pk, append(hdr[:17:17], body...), hdr[17:]) {
+		return nil, "", "badmac"
+	}
+	return body, Ed25519Identity(pk), ""
+}
@@ -0,0 +1,86 @@
+package petrel
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// hammer one Client from many goroutines, checking that everyone
+// gets their own response back
+func clienthammer(t *testing.T, ac *Client, workers, reqs int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for j := 0; j < reqs; j++ {
+				msg := fmt.Sprintf("worker %d request %d", w, j)
+				resp, err := ac.Dispatch([]byte("echo " + msg))
+				if err != nil {
+					t.Errorf("worker %d: Dispatch returned error: %v", w, err)
+					return
+				}
+				if string(resp) != msg {
+					t.Errorf("worker %d: expected '%s' but got '%s'", w, msg, string(resp))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientConcurrentDispatch(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50713", Msglvl: Fatal, Inflight: 8}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "blob", hollaback)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	clienthammer(t, ac, 40, 50)
+	if ac.Seq != 2000 {
+		t.Errorf("client Seq should be 2000 but is %d", ac.Seq)
+	}
+	ac.Quit()
+	as.Quit()
+}
+
+func TestClientConcurrentDispatchSerialServer(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50713", Msglvl: Fatal}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "blob", hollaback)
+	// this Client has an HMAC key and the Server doesn't, so
+	// the Client's first request will kill the connection. every
+	// concurrent caller should get an error rather than hang.
+	ac, err := TCPClient(&ClientConfig{Addr: as.s, HMACKey: []byte("a key")})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ac.Dispatch([]byte("echo hi")); err == nil {
+				t.Errorf("expected an error on a dead connection")
+			}
+		}()
+	}
+	wg.Wait()
+	ac.Quit()
+
+	ac, err = TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	clienthammer(t, ac, 30, 20)
+	ac.Quit()
+	as.Quit()
+}
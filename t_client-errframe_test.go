@@ -0,0 +1,102 @@
+package petrel
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientErrFrames(t *testing.T) {
+	for _, redact := range []bool{false, true} {
+		c := &ServerConfig{Sockname: "/tmp/test22.sock", Msglvl: Fatal, RedactErrs: redact}
+		as, err := UnixServer(c, 700)
+		if err != nil {
+			t.Fatalf("Couldn't create socket: %v", err)
+		}
+		as.Register("badecho", "argv", badecho)
+		ac, err := UnixClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		resp, err := ac.Dispatch([]byte("badecho foo"))
+		if len(resp) != 1 || resp[0] != 255 {
+			t.Errorf("resp should be [255] but got %v", resp)
+		}
+		var p *Perr
+		if !errors.As(err, &p) {
+			t.Fatalf("error should be a *Perr but is %T: %v", err, err)
+		}
+		if p.Code != 500 || p.Kind != "reqerr" || p.Txt != "request failed" {
+			t.Errorf("unexpected Perr: %#v", p)
+		}
+		if redact {
+			if p.Msg != "" {
+				t.Errorf("error text should have been redacted but got '%s'", p.Msg)
+			}
+			if err.Error() != "request failed (500)" {
+				t.Errorf("unexpected error text: %s", err)
+			}
+		} else {
+			if p.Msg != "oh no something is wrong" {
+				t.Errorf("expected responder error text but got '%s'", p.Msg)
+			}
+			if err.Error() != "request failed (500): oh no something is wrong" {
+				t.Errorf("unexpected error text: %s", err)
+			}
+		}
+		// other errors carry their kind too
+		_, err = ac.Dispatch([]byte("nope"))
+		if !errors.As(err, &p) || p.Code != 400 || p.Kind != "badreq" || p.Msg != "" {
+			t.Errorf("unexpected error for bad command: %#v", err)
+		}
+		ac.Quit()
+		as.Quit()
+	}
+}
+
+func TestClientUnframe(t *testing.T) {
+	// frames, including codes we don't know about
+	p := unframe([]byte("PERRPERR777\x00weird\x00a\x00message"))
+	if p == nil || p.Code != 777 || p.Kind != "weird" || p.Msg != "a\x00message" || p.Txt != "unknown error" {
+		t.Errorf("unexpected Perr from frame: %#v", p)
+	}
+	// and things which aren't frames
+	// (including old-style frames, which belong to an earlier
+	// protocol version)
+	for _, r := range []string{"PERRPERR", "PERRPERR502", "PERRPERR5000", "PERRPERRabc", "PERRPERRabc\x00x\x00y", "hello there"} {
+		if p = unframe([]byte(r)); p != nil {
+			t.Errorf("'%s' should not decode but got %#v", r, p)
+		}
+	}
+	// round trip
+	p = unframe(perrs["reqerr"].frame("reqerr", "boom"))
+	if p == nil || p.Code != 500 || p.Kind != "reqerr" || p.Msg != "boom" {
+		t.Errorf("unexpected Perr from frame: %#v", p)
+	}
+}
+
+func TestServOldProto(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50745", Msglvl: Fatal}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("badecho", "argv", badecho)
+	// an old Client, which wouldn't understand our error frames,
+	// is hung up on
+	conn, err := net.Dial("tcp", as.s)
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+	defer conn.Close()
+	req := []byte("badecho foo")
+	conn.Write(append(xheader(1, uint32(len(req)), 0), req...))
+	var seq uint32
+	var id string
+	resp, perr, _, err := connRead(conn, time.Second, 0, nil, &seq, &id, nil)
+	if perr != "disconnect" {
+		t.Errorf("expected disconnect, but got '%s' / %s %v", resp, perr, err)
+	}
+}
@@ -0,0 +1,169 @@
+package petrel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientPool(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50714", Msglvl: Fatal, Reqlen: 64}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "blob", hollaback)
+
+	// bad configs
+	cc := &ClientConfig{Addr: as.s}
+	if _, err = TCPClientPool(cc, &PoolConfig{}); err == nil {
+		t.Errorf("pool with size 0 should have failed")
+	}
+	if _, err = TCPClientPool(cc, &PoolConfig{Size: 4, MinIdle: 3, MaxIdle: 2}); err == nil {
+		t.Errorf("pool with MinIdle > MaxIdle should have failed")
+	}
+	if _, err = TCPClientPool(&ClientConfig{Addr: "127.0.0.1:1"}, &PoolConfig{Size: 1, MinIdle: 1}); err == nil {
+		t.Errorf("pool which can't connect should have failed")
+	}
+
+	cp, err := TCPClientPool(cc, &PoolConfig{Size: 4, MinIdle: 2, MaxIdle: 3})
+	if err != nil {
+		t.Fatalf("Couldn't create pool: %v", err)
+	}
+	if o, i := cp.Len(); o != 2 || i != 2 {
+		t.Errorf("expected 2 open, 2 idle conns but got %d, %d", o, i)
+	}
+	// hammer it
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				msg := fmt.Sprintf("%d %d", i, j)
+				resp, err := cp.Dispatch([]byte("echo " + msg))
+				if err != nil {
+					t.Errorf("Dispatch returned error: %v", err)
+				}
+				if string(resp) != msg {
+					t.Errorf("expected '%s' but got '%s'", msg, string(resp))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if o, i := cp.Len(); o > 3 || i > 3 {
+		t.Errorf("expected at most 3 open, 3 idle conns but got %d, %d", o, i)
+	}
+
+	// a request which is too long gets the connection closed by
+	// the Server. the pool should discard it and carry on.
+	cl, _ := cp.Get()
+	_, err = cl.Dispatch([]byte("echo this request is far too long for the server to accept at all"))
+	if err == nil || err.(*Perr).Code != 402 {
+		t.Errorf("expected 402 but got %v", err)
+	}
+	o, _ := cp.Len()
+	cp.Put(cl)
+	if o2, _ := cp.Len(); o2 != o-1 {
+		t.Errorf("closed Client should have been discarded: %d open before, %d after", o, o2)
+	}
+	resp, err := cp.Dispatch([]byte("echo still works"))
+	if err != nil || string(resp) != "still works" {
+		t.Errorf("Expected 'still works' but got '%s' / %v", string(resp), err)
+	}
+
+	cp.Close()
+	if _, err = cp.Get(); err == nil {
+		t.Errorf("Get on a closed pool should fail")
+	}
+	if o, i := cp.Len(); o != 0 || i != 0 {
+		t.Errorf("closed pool should have no conns but has %d, %d", o, i)
+	}
+	as.Quit()
+}
+
+func TestClientPoolJanitor(t *testing.T) {
+	// the Server drops idle conns after 60ms
+	c := &ServerConfig{Sockname: "/tmp/test21.sock", Msglvl: Fatal, Timeout: 60}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "blob", hollaback)
+	cp, err := UnixClientPool(&ClientConfig{Addr: as.s}, &PoolConfig{Size: 4, MinIdle: 1, IdleTimeout: 40, Probe: 20})
+	if err != nil {
+		t.Fatalf("Couldn't create pool: %v", err)
+	}
+	// check out 3 Clients and return them
+	cls := []*Client{}
+	for i := 0; i < 3; i++ {
+		cl, err := cp.Get()
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		cls = append(cls, cl)
+	}
+	for _, cl := range cls {
+		cp.Put(cl)
+	}
+	if o, i := cp.Len(); o != 3 || i != 3 {
+		t.Errorf("expected 3 open, 3 idle conns but got %d, %d", o, i)
+	}
+	// idle eviction should take us down to MinIdle, and probes
+	// should keep the last conn alive past the Server's timeout
+	time.Sleep(150 * time.Millisecond)
+	if o, i := cp.Len(); o != 1 || i != 1 {
+		t.Errorf("expected 1 open, 1 idle conn but got %d, %d", o, i)
+	}
+	resp, err := cp.Dispatch([]byte("echo still works"))
+	if err != nil || string(resp) != "still works" {
+		t.Errorf("Expected 'still works' but got '%s' / %v", string(resp), err)
+	}
+	cp.Close()
+	as.Quit()
+}
+
+func TestClientPoolProbeStuck(t *testing.T) {
+	// a "server" which accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:50748")
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer l.Close()
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+	// the Clients have no Timeout, so the probe's own deadline
+	// is all that notices they're stuck
+	cp, err := TCPClientPool(&ClientConfig{Addr: "127.0.0.1:50748"}, &PoolConfig{Size: 2, MinIdle: 1, Probe: 20})
+	if err != nil {
+		t.Fatalf("Couldn't create pool: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := len(conns); n < 2 {
+		t.Errorf("stuck Client should have been replaced, but there have been %d conns", n)
+	}
+	done := make(chan bool)
+	go func() {
+		cp.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Close is stuck on a probe")
+	}
+	for len(conns) > 0 {
+		(<-conns).Close()
+	}
+}
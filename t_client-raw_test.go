@@ -1,7 +1,10 @@
 package petrel
 
 import (
+	"bytes"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestRawClientNewTCP(t *testing.T) {
@@ -62,3 +65,50 @@ func TestRawClientNewTCP(t *testing.T) {
 	c.Quit()
 	as.Quit()
 }
+
+func TestRawClientSealed(t *testing.T) {
+	// a bare server which answers with a transmission sealed on its
+	// own side, so that it has a nonce and timestamp the client
+	// could not reproduce
+	cc := &ClientConfig{Addr: "127.0.0.1:50750", HMACKey: []byte("test"), ReplayWindow: 2000}
+	sl := cc.sealer()
+	l, err := net.Listen("tcp", cc.Addr)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer l.Close()
+	sent := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var seq uint32
+		req, _, _, err := connRead(conn, time.Second, 0, sl, &seq, nil, nil)
+		if err != nil {
+			return
+		}
+		xmission, _, _ := marshalXmission(req, sl, seq)
+		sent <- xmission
+		conn.Write(xmission)
+		conn.Read(make([]byte, 1))
+	}()
+
+	c, err := TCPClient(cc)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Quit()
+	xmission, _, err := marshalXmission([]byte("echo raw"), sl, 1)
+	if err != nil {
+		t.Fatalf("marshalXmission returned error: %s", err)
+	}
+	resp, err := c.DispatchRaw(xmission)
+	if err != nil {
+		t.Fatalf("DispatchRaw returned error: %v", err)
+	}
+	if want := <-sent; !bytes.Equal(resp, want) {
+		t.Errorf("expected the transmission as sent\n%q\nbut got\n%q", want, resp)
+	}
+}
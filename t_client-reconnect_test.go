@@ -0,0 +1,159 @@
+package petrel
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientReconnect(t *testing.T) {
+	// the Server times out idle conns, so Quit won't hang on our
+	// Client's connection
+	sc := &ServerConfig{Sockname: "127.0.0.1:50715", Msglvl: Fatal, Timeout: 50}
+	as, err := TCPServer(sc)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "blob", hollaback)
+
+	var m sync.Mutex
+	var fails, oks int
+	rp := &ReconnectPolicy{Attempts: 50, Base: 5, Max: 20, Jitter: 0.5,
+		Notify: func(n int, err error) {
+			m.Lock()
+			defer m.Unlock()
+			if err != nil {
+				fails++
+			} else {
+				oks++
+			}
+		}}
+	ac, err := TCPClient(&ClientConfig{Addr: as.s, Reconnect: rp})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	// and one without a policy, for comparison
+	ac2, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	resp, err := ac.Dispatch([]byte("echo before"))
+	if err != nil || string(resp) != "before" {
+		t.Errorf("Expected 'before' but got '%s' / %v", string(resp), err)
+	}
+
+	// "restart" the Server, and give the Client a moment to notice
+	// that its connection is gone. (a request written before then
+	// would be lost with the connection, and not retried.)
+	as.Quit()
+	time.Sleep(10 * time.Millisecond)
+	asc := make(chan *Server)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		as, err := TCPServer(sc)
+		if err != nil {
+			t.Errorf("Couldn't recreate socket: %v", err)
+		}
+		asc <- as
+	}()
+	// the new Server has no Responders; a nil request gets a
+	// reply regardless
+	_, err = ac.Dispatch([]byte(""))
+	if p, ok := err.(*Perr); !ok || p.Code != 401 {
+		t.Errorf("Expected nil request error but got: %v", err)
+	}
+	if as = <-asc; as == nil {
+		t.FailNow()
+	}
+	m.Lock()
+	if fails == 0 || oks != 1 {
+		t.Errorf("expected some failed attempts and 1 success, but got %d and %d", fails, oks)
+	}
+	m.Unlock()
+	_, err = ac2.Dispatch([]byte("echo after"))
+	if err == nil || !strings.HasPrefix(err.Error(), "the network connection is closed") {
+		t.Errorf("Client without Reconnect should stay closed, but got: %v", err)
+	}
+
+	// a Client which has been told to Quit doesn't come back
+	ac.Quit()
+	_, err = ac.Dispatch([]byte("echo after quit"))
+	if err == nil {
+		t.Errorf("Dispatch after Quit should fail")
+	}
+	ac2.Quit()
+	as.Quit()
+
+	// and with no Server to talk to, we eventually give up
+	ac, err = TCPClient(&ClientConfig{Addr: "127.0.0.1:50715", Reconnect: &ReconnectPolicy{Attempts: 3, Base: 1}})
+	if err == nil {
+		ac.Dispatch([]byte("echo hi"))
+		t.Errorf("Client creation should have failed")
+	}
+	as, err = TCPServer(sc)
+	if err != nil {
+		t.Fatalf("Couldn't recreate socket: %v", err)
+	}
+	ac, err = TCPClient(&ClientConfig{Addr: as.s, Reconnect: &ReconnectPolicy{Attempts: 3, Base: 1}})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	as.Quit()
+	time.Sleep(10 * time.Millisecond)
+	_, err = ac.Dispatch([]byte("echo hi"))
+	if err == nil || !strings.HasPrefix(err.Error(), "reconnect failed after 3 attempts") {
+		t.Errorf("Expected reconnect failure, but got: %v", err)
+	}
+	ac.Quit()
+}
+
+func TestClientReconnectBackoff(t *testing.T) {
+	rp := &ReconnectPolicy{Base: 10, Max: 100}
+	for n, x := range []time.Duration{10, 20, 40, 80, 100, 100} {
+		if d := rp.backoff(n + 1); d != x*time.Millisecond {
+			t.Errorf("attempt %d: expected %v but got %v", n+1, x*time.Millisecond, d)
+		}
+	}
+	rp.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		if d := rp.backoff(3); d > 40*time.Millisecond || d < 20*time.Millisecond {
+			t.Errorf("jittered backoff out of range: %v", d)
+		}
+	}
+}
+
+func TestClientStaleErrFrame(t *testing.T) {
+	sc := &ServerConfig{Sockname: "127.0.0.1:50747", Msglvl: Fatal}
+	as, err := TCPServer(sc)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("echo", "blob", hollaback)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s, Reconnect: &ReconnectPolicy{Attempts: 1}})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer ac.Quit()
+	// reconnect, leaving the old conn behind
+	ac.m.Lock()
+	old := ac.conn
+	ac.cc = true
+	ac.m.Unlock()
+	if err = ac.reconnect(); err != nil {
+		t.Fatalf("couldn't reconnect: %s", err)
+	}
+	// a connection-closing error which arrived on the old conn
+	// doesn't affect the new one
+	if _, err = ac.unpack(perrs["badmac"].frame("badmac", ""), old); err == nil {
+		t.Errorf("expected badmac error")
+	}
+	if ac.closed() {
+		t.Errorf("new connection should not be marked closed")
+	}
+	resp, err := ac.Dispatch([]byte("echo hi"))
+	if err != nil || string(resp) != "hi" {
+		t.Errorf("Expected 'hi' but got '%s' / %v", string(resp), err)
+	}
+}
@@ -38,10 +38,6 @@ func TestClientClientTimeout(t *testing.T) {
 	}
 
 	// now send a message which will take too long to come back.
-	// NB this test is here more to check timeout handling than
-	// anything else. Client.read is now unexported, and it is not
-	// recommended that users check Client errors and attempt
-	// do-overs. That's just a good way to get things de-synced.
 	resp, err = c.Dispatch([]byte("slow just the one test, slowly"))
 	if err == nil {
 		t.Errorf("Dispatch should have timed out, but no error. Got: %v", string(resp))
@@ -49,14 +45,16 @@ func TestClientClientTimeout(t *testing.T) {
 	if err != nil && !strings.HasSuffix(err.Error(), "i/o timeout") {
 		t.Errorf("Expected read timeout, but got: %v", err)
 	}
-	// wait a bit and see what we get if we check the socket again
+	// wait a bit for the late response to arrive. responses are
+	// matched to requests by sequence id, so it should be
+	// discarded rather than handed to the next Dispatch.
 	time.Sleep(40 * time.Millisecond)
-	resp, err = c.read(false)
+	resp, err = c.Dispatch([]byte("echo and another"))
 	if err != nil {
-		t.Errorf("Read returned error: %v", err)
+		t.Errorf("Dispatch returned error: %v", err)
 	}
-	if string(resp) != "just the one test, slowly" {
-		t.Errorf("Expected `just the one test, slowly` but got: `%v`", string(resp))
+	if string(resp) != "and another" {
+		t.Errorf("Expected `and another` but got: `%v`", string(resp))
 	}
 	c.Quit()
 	as.Quit()
@@ -0,0 +1,39 @@
+package petrel
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestServAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if _, err := UnixServer(&ServerConfig{Sockname: "@petrel-test34"}, 700); err == nil {
+			t.Errorf("abstract sockets should not work on %s", runtime.GOOS)
+		}
+		return
+	}
+	for i := 0; i < 2; i++ {
+		// the second time around, the name should be free again
+		c := &ServerConfig{Sockname: "@petrel-test34", Msglvl: Fatal, UnixClean: true, UnixDirPerm: 0700,
+			PeerUIDs: []uint32{uint32(os.Getuid())}}
+		as, err := UnixServer(c, 700)
+		if err != nil {
+			t.Fatalf("Couldn't create socket: %v", err)
+		}
+		as.Register("who", "argv", whoareyou)
+		if _, err = os.Stat("@petrel-test34"); !os.IsNotExist(err) {
+			t.Errorf("abstract socket should have no file, but got %v", err)
+		}
+		ac, err := UnixClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		resp, err := ac.Dispatch([]byte("who"))
+		if err != nil || string(resp) == "nobody" {
+			t.Errorf("expected peer credentials but got '%s' / %v", string(resp), err)
+		}
+		ac.Quit()
+		as.Quit()
+	}
+}
@@ -0,0 +1,102 @@
+package petrel
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestServNewServer(t *testing.T) {
+	if _, err := NewServer(&ServerConfig{}, nil); err == nil {
+		t.Errorf("NewServer with no listener should have failed")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:50728")
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	c := &ServerConfig{Msglvl: Fatal}
+	as, err := NewServer(c, tls.NewListener(l, servertc))
+	if err != nil {
+		t.Fatalf("Couldn't create server: %v", err)
+	}
+	if c.Sockname != "127.0.0.1:50728" {
+		t.Errorf("Sockname should be '127.0.0.1:50728' but got '%s'", c.Sockname)
+	}
+	as.Register("echo", "argv", echo)
+	ac, err := TLSClient(&ClientConfig{Addr: c.Sockname}, clienttc)
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	resp, err := ac.Dispatch([]byte("echo hi"))
+	if err != nil || string(resp) != "hi" {
+		t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+	}
+	ac.Quit()
+	as.Quit()
+}
+
+// TestServSystemdChild is not a real test. It is the child process
+// for TestServSystemd.
+func TestServSystemdChild(t *testing.T) {
+	if os.Getenv("PETREL_TEST_SYSTEMD") == "" {
+		return
+	}
+	ls, ns, err := SystemdListeners()
+	if err != nil || len(ls) != 2 || ns[0] != "admin" || ns[1] != "unknown" {
+		t.Fatalf("unexpected listeners: %v %v %v", ls, ns, err)
+	}
+	if _, err = SystemdServer(&ServerConfig{}, "nosuch"); err == nil {
+		t.Errorf("SystemdServer should have failed for a missing name")
+	}
+	as, err := SystemdServer(&ServerConfig{Msglvl: Conn}, "unknown")
+	if err != nil {
+		t.Fatalf("Couldn't create server: %v", err)
+	}
+	as.Register("who", "argv", whoami("activated"))
+	for msg := range as.Msgr {
+		if msg.Code == 198 {
+			break
+		}
+	}
+	ls[0].Close()
+	as.Quit()
+}
+
+func TestServSystemd(t *testing.T) {
+	var fs []*os.File
+	for _, addr := range []string{"127.0.0.1:50729", "127.0.0.1:50730"} {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("Couldn't create socket: %v", err)
+		}
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("Couldn't get listener file: %v", err)
+		}
+		l.Close()
+		defer f.Close()
+		fs = append(fs, f)
+	}
+	// LISTEN_PID has to be the child's pid, so let the shell
+	// set it before exec'ing the test binary
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" -test.run=TestServSystemdChild`, os.Args[0])
+	cmd.Env = append(os.Environ(), "PETREL_TEST_SYSTEMD=1", "LISTEN_FDS=2", "LISTEN_FDNAMES=admin:")
+	cmd.ExtraFiles = fs
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("couldn't start child: %v", err)
+	}
+	ac, err := TCPClient(&ClientConfig{Addr: "127.0.0.1:50730", Timeout: 5000})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	resp, err := ac.Dispatch([]byte("who"))
+	if err != nil || string(resp) != "activated" {
+		t.Errorf("expected 'activated' but got '%s' / %v", string(resp), err)
+	}
+	ac.Quit()
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("child process failed: %v", err)
+	}
+}
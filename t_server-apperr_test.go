@@ -0,0 +1,73 @@
+package petrel
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// lookup pretends to be a key/value store with nothing in it
+func lookup(args [][]byte) ([]byte, error) {
+	switch string(args[0]) {
+	case "wrapped":
+		return nil, fmt.Errorf("lookup failed: %w", &AppErr{Code: 1409, Txt: "conflict"})
+	case "outofrange":
+		return nil, &AppErr{Code: 404, Txt: "not found"}
+	}
+	return nil, &AppErr{Code: 1404, Txt: "no such key"}
+}
+
+func TestServAppErr(t *testing.T) {
+	c := &ServerConfig{Sockname: "/tmp/test23.sock", Msglvl: All, RedactErrs: true}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("get", "argv", lookup)
+	ac, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+
+	var ae *AppErr
+	_, err = ac.Dispatch([]byte("get foo"))
+	if !errors.As(err, &ae) {
+		t.Fatalf("error should be an *AppErr but is %T: %v", err, err)
+	}
+	if ae.Code != 1404 || ae.Txt != "no such key" || err.Error() != "no such key (1404)" {
+		t.Errorf("unexpected AppErr: %#v", ae)
+	}
+	_, err = ac.Dispatch([]byte("get wrapped"))
+	if !errors.As(err, &ae) || ae.Code != 1409 || ae.Txt != "conflict" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	// codes outside the reserved range are just errors (and
+	// this Server redacts those)
+	_, err = ac.Dispatch([]byte("get outofrange"))
+	if errors.As(err, &ae) {
+		t.Errorf("out-of-range code shouldn't produce an AppErr, but got %#v", ae)
+	}
+	if p, ok := err.(*Perr); !ok || p.Code != 500 || p.Msg != "" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	ac.Quit()
+
+	// check what was reported via Msgr
+	<-as.Msgr // connect
+	<-as.Msgr // dispatch
+	msg := <-as.Msgr
+	if msg.Code != 1404 || msg.Txt != "application error: [no such key]" || msg.Err != nil {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	<-as.Msgr // dispatch
+	msg = <-as.Msgr
+	if msg.Code != 1409 || msg.Txt != "application error: [conflict]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	<-as.Msgr // dispatch
+	msg = <-as.Msgr
+	if msg.Code != 500 || msg.Err.Error() != "not found (404)" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	as.Quit()
+}
@@ -0,0 +1,169 @@
+package petrel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// checkRefused dials a Server and checks that the connection is
+// refused for the given reason
+func checkRefused(t *testing.T, addr, why string) {
+	ac, err := TCPClient(&ClientConfig{Addr: addr})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer ac.Quit()
+	_, err = ac.Dispatch([]byte("echo hi"))
+	if p, ok := err.(*Perr); !ok || p.Code != 403 || p.Kind != "refused" || p.Msg != why {
+		t.Errorf("expected refusal '%s', but got %#v", why, err)
+	}
+}
+
+func TestServConnLimits(t *testing.T) {
+	for _, c := range []*ServerConfig{
+		{Sockname: "127.0.0.1:50718", Msglvl: Conn, MaxConns: 2},
+		{Sockname: "127.0.0.1:50719", Msglvl: Conn, MaxConnsPerIP: 2, IPv4Prefix: 8},
+	} {
+		why := "too many connections"
+		if c.MaxConnsPerIP > 0 {
+			why = "too many connections from this address"
+		}
+		as, err := TCPServer(c)
+		if err != nil {
+			t.Fatalf("Couldn't create socket: %v", err)
+		}
+		as.Register("echo", "argv", echo)
+		go func() {
+			for range as.Msgr {
+			}
+		}()
+		acs := []*Client{}
+		for i := 0; i < 2; i++ {
+			ac, err := TCPClient(&ClientConfig{Addr: as.s})
+			if err != nil {
+				t.Fatalf("client instantiation failed! %s", err)
+			}
+			if resp, err := ac.Dispatch([]byte("echo hi")); err != nil || string(resp) != "hi" {
+				t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+			}
+			acs = append(acs, ac)
+		}
+		checkRefused(t, as.s, why)
+		// closing a connection makes room for another
+		acs[0].Quit()
+		time.Sleep(20 * time.Millisecond)
+		ac, err := TCPClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		if resp, err := ac.Dispatch([]byte("echo hi")); err != nil || string(resp) != "hi" {
+			t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+		}
+		ac.Quit()
+		acs[1].Quit()
+		as.Quit()
+	}
+}
+
+func TestServAcceptRate(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50720", Msglvl: Conn, AcceptRate: 1, AcceptBurst: 2}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "argv", echo)
+	for i := 0; i < 2; i++ {
+		ac, err := TCPClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		if resp, err := ac.Dispatch([]byte("echo hi")); err != nil || string(resp) != "hi" {
+			t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+		}
+		ac.Quit()
+		<-as.Msgr // connect
+		<-as.Msgr // disconnect
+	}
+	checkRefused(t, as.s, "accept rate exceeded")
+	msg := <-as.Msgr
+	if msg.Code != 403 || msg.Txt != "connection refused: [accept rate exceeded]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	as.Quit()
+}
+
+func TestServRefuseStalled(t *testing.T) {
+	rt := refuseTime
+	refuseTime = 100 * time.Millisecond
+	defer func() { refuseTime = rt }()
+	c := &ServerConfig{Sockname: "127.0.0.1:50741", Msglvl: Fatal, MaxConns: 1}
+	as, err := TLSServer(c, servertc)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "argv", echo)
+	ac, err := TLSClient(&ClientConfig{Addr: as.s}, clienttc)
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer ac.Quit()
+	// a refused client which never does the TLS handshake
+	// doesn't hold up Shutdown
+	conn, err := net.Dial("tcp", as.s)
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan error)
+	go func() { done <- as.Shutdown(context.Background()) }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Shutdown returned error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Shutdown is stuck on a refused client")
+	}
+}
+
+func TestServRefuseBacklog(t *testing.T) {
+	rm := refuseMax
+	refuseMax = 0
+	defer func() { refuseMax = rm }()
+	c := &ServerConfig{Sockname: "127.0.0.1:50742", Msglvl: Conn, MaxConns: 1}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("echo", "argv", echo)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer ac.Quit()
+	<-as.Msgr // connect
+	// with a backlog of refusals, clients are hung up on without
+	// a notice
+	bc, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer bc.Quit()
+	if _, err = bc.Dispatch([]byte("echo hi")); err == nil {
+		t.Errorf("refused client should have been hung up on")
+	} else if p, ok := err.(*Perr); ok && p.Code == 403 {
+		t.Errorf("refused client shouldn't have been sent a notice")
+	}
+	msg := <-as.Msgr
+	if msg.Code != 403 || msg.Txt != "connection refused: [too many connections (no notice sent)]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	go func() {
+		for range as.Msgr {
+		}
+	}()
+}
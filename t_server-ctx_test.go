@@ -0,0 +1,143 @@
+package petrel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reqinfo reports back what it knows about the request
+func reqinfo(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+	return []byte(fmt.Sprintf("%d %d %s %v", ri.Conn, ri.Req, ri.Cmd, ri.TLS != nil)), nil
+}
+
+// waitquit blocks until its context is cancelled
+func waitquit(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+	<-ctx.Done()
+	return []byte(ctx.Err().Error()), nil
+}
+
+func TestServContextResponder(t *testing.T) {
+	c := &ServerConfig{Sockname: "/tmp/test20.sock", Msglvl: All}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	err = as.Register("info", "argv", reqinfo)
+	if err != nil {
+		t.Errorf("Couldn't add ContextResponder: %v", err)
+	}
+	err = as.Register("wait", "argv", ContextResponder(waitquit))
+	if err != nil {
+		t.Errorf("Couldn't add ContextResponder: %v", err)
+	}
+	err = as.Register("bad", "argv", func() {})
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid responder type") {
+		t.Errorf("Expected invalid responder type, but got: %v", err)
+	}
+
+	ac, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	resp, err := ac.Dispatch([]byte("info"))
+	if err != nil {
+		t.Errorf("Dispatch returned error: %v", err)
+	}
+	if string(resp) != "1 1 info false" {
+		t.Errorf("Expected '1 1 info false' but got '%s'", string(resp))
+	}
+	resp, err = ac.Dispatch([]byte("info again"))
+	if string(resp) != "1 2 info false" {
+		t.Errorf("Expected '1 2 info false' but got '%s'", string(resp))
+	}
+
+	// now dispatch a request which only returns when Quit is called
+	done := make(chan string)
+	go func() {
+		resp, err := ac.Dispatch([]byte("wait"))
+		if err != nil {
+			t.Errorf("Dispatch returned error: %v", err)
+		}
+		ac.Quit()
+		done <- string(resp)
+	}()
+	for {
+		msg := <-as.Msgr
+		if msg.Txt == "dispatching: [wait]" {
+			break
+		}
+	}
+	as.Quit()
+	if s := <-done; s != "context canceled" {
+		t.Errorf("Expected 'context canceled' but got '%s'", s)
+	}
+}
+
+func TestServContextResponderTLS(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50711", Msglvl: Fatal}
+	as, err := TLSServer(c, servertc)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("info", "argv", reqinfo)
+	ac, err := TLSClient(&ClientConfig{Addr: as.s}, clienttc)
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	resp, err := ac.Dispatch([]byte("info"))
+	if err != nil {
+		t.Errorf("Dispatch returned error: %v", err)
+	}
+	if string(resp) != "1 1 info true" {
+		t.Errorf("Expected '1 1 info true' but got '%s'", string(resp))
+	}
+	ac.Quit()
+	as.Quit()
+}
+
+func TestServContextDisconnect(t *testing.T) {
+	c := &ServerConfig{Sockname: "/tmp/test35.sock", Msglvl: Fatal}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("echo", "argv", echo)
+	as.Register("ctxnap", "argv", func(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+		return napper(args)
+	})
+	cancelled := make(chan bool)
+	as.Register("wait", "argv", func(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	ac, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	// requests sent while a ContextResponder is running (and
+	// the conn is being watched) are still read intact
+	call := ac.Go([]byte("ctxnap 50"))
+	resp, err := ac.Dispatch([]byte("echo hi"))
+	if err != nil || string(resp) != "hi" {
+		t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+	}
+	<-call.Done
+	if call.Err != nil || string(call.Resp) != "50" {
+		t.Errorf("expected '50' but got '%s' / %v", string(call.Resp), call.Err)
+	}
+	// and when the client hangs up, the Context of the request
+	// being handled is cancelled
+	ac.Go([]byte("wait"))
+	time.Sleep(20 * time.Millisecond)
+	ac.Quit()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("ContextResponder's Context was not cancelled")
+	}
+}
@@ -0,0 +1,101 @@
+package petrel
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestServDispatchChanges(t *testing.T) {
+	c := &ServerConfig{Sockname: "/tmp/test26.sock", Msglvl: Fatal, Inflight: 4}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "argv", echo)
+	ac, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+
+	// errors
+	if err = as.Replace("nope", "argv", echo); err == nil || err.Error() != "handler 'nope' does not exist" {
+		t.Errorf("expected nonexistent handler error but got %v", err)
+	}
+	if err = as.Unregister("nope"); err == nil || err.Error() != "handler 'nope' does not exist" {
+		t.Errorf("expected nonexistent handler error but got %v", err)
+	}
+	if err = as.Replace("echo", "nope", echo); err == nil || err.Error() != "invalid mode 'nope'" {
+		t.Errorf("expected invalid mode error but got %v", err)
+	}
+
+	// replace echo with something else
+	err = as.Replace("echo", "blob", func(args [][]byte) ([]byte, error) {
+		return append([]byte("replaced: "), args[0]...), nil
+	})
+	if err != nil {
+		t.Errorf("Replace failed: %v", err)
+	}
+	resp, err := ac.Dispatch([]byte("echo foo"))
+	if err != nil || string(resp) != "replaced: foo" {
+		t.Errorf("expected 'replaced: foo' but got '%s' / %v", string(resp), err)
+	}
+	// and now take it away
+	if err = as.Unregister("echo"); err != nil {
+		t.Errorf("Unregister failed: %v", err)
+	}
+	_, err = ac.Dispatch([]byte("echo foo"))
+	if p, ok := err.(*Perr); !ok || p.Code != 400 {
+		t.Errorf("expected bad command error but got %v", err)
+	}
+
+	// build a whole new table and swap it in
+	dt := NewDispatchTable()
+	dt.Register("echo", "argv", echo)
+	dt.Register("hollaback", "blob", hollaback)
+	if err = dt.Register("echo", "argv", echo); err == nil {
+		t.Errorf("duplicate Register on DispatchTable should fail")
+	}
+	if err = dt.Register("bad", "argv", 42); err == nil {
+		t.Errorf("Register of non-Responder on DispatchTable should fail")
+	}
+	as.Swap(dt)
+	resp, err = ac.Dispatch([]byte("hollaback foo bar"))
+	if err != nil || string(resp) != "foo bar" {
+		t.Errorf("expected 'foo bar' but got '%s' / %v", string(resp), err)
+	}
+
+	// finally, churn the table while hammering the Server. the
+	// race detector is the real test here.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			name := fmt.Sprintf("cmd%d", i%5)
+			if as.Register(name, "argv", echo) != nil {
+				as.Replace(name, "blob", hollaback)
+				as.Unregister(name)
+			}
+			if i%50 == 0 {
+				as.Swap(dt)
+			}
+		}
+	}()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				resp, err := ac.Dispatch([]byte("echo hi"))
+				if err != nil || string(resp) != "hi" {
+					t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+				}
+				ac.Dispatch([]byte(fmt.Sprintf("cmd%d hi", j%5)))
+			}
+		}()
+	}
+	wg.Wait()
+	ac.Quit()
+	as.Quit()
+}
@@ -0,0 +1,146 @@
+package petrel
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// whoami returns a Responder which answers with 'name', so we can
+// tell which Server handled a request
+func whoami(name string) Responder {
+	return func(args [][]byte) ([]byte, error) {
+		return []byte(name), nil
+	}
+}
+
+func TestServFileServer(t *testing.T) {
+	for _, sn := range []string{"127.0.0.1:50726", "/tmp/test29.sock"} {
+		c := &ServerConfig{Sockname: sn, Msglvl: Fatal}
+		var as *Server
+		var err error
+		if sn[0] == '/' {
+			as, err = UnixServer(c, 700)
+		} else {
+			as, err = TCPServer(c)
+		}
+		if err != nil {
+			t.Fatalf("Couldn't create socket: %v", err)
+		}
+		as.Register("who", "argv", whoami("old"))
+		f, err := as.ListenerFile()
+		if err != nil {
+			t.Fatalf("Couldn't get listener file: %v", err)
+		}
+		// the old Server goes away, but the socket stays put
+		as.Shutdown(context.Background())
+		c2 := &ServerConfig{Msglvl: Fatal}
+		as2, err := FileServer(c2, f)
+		if err != nil {
+			t.Fatalf("Couldn't create server from file: %v", err)
+		}
+		if c2.Sockname != sn {
+			t.Errorf("Sockname should be '%s' but got '%s'", sn, c2.Sockname)
+		}
+		as2.Register("who", "argv", whoami("new"))
+		var ac *Client
+		if sn[0] == '/' {
+			ac, err = UnixClient(&ClientConfig{Addr: sn})
+		} else {
+			ac, err = TCPClient(&ClientConfig{Addr: sn})
+		}
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		resp, err := ac.Dispatch([]byte("who"))
+		if err != nil || string(resp) != "new" {
+			t.Errorf("expected 'new' but got '%s' / %v", string(resp), err)
+		}
+		ac.Quit()
+		as2.Quit()
+	}
+	os.Remove("/tmp/test29.sock")
+}
+
+// TestServHandoffChild is not a real test. It is the child process
+// for TestServHandoff.
+func TestServHandoffChild(t *testing.T) {
+	if os.Getenv("PETREL_TEST_HANDOFF") == "" {
+		return
+	}
+	f, err := HandoffFile()
+	if err != nil || f == nil {
+		t.Fatalf("no listener handed off: %v", err)
+	}
+	as, err := FileServer(&ServerConfig{Msglvl: Conn}, f)
+	if err != nil {
+		t.Fatalf("Couldn't create server from file: %v", err)
+	}
+	as.Register("who", "argv", whoami("child"))
+	// serve one client, then exit
+	for msg := range as.Msgr {
+		if msg.Code == 198 {
+			break
+		}
+	}
+	as.Quit()
+}
+
+func TestServHandoff(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50727", Msglvl: Fatal}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("who", "argv", whoami("parent"))
+	cmd := exec.Command(os.Args[0], "-test.run=TestServHandoffChild")
+	cmd.Env = append(os.Environ(), "PETREL_TEST_HANDOFF=1")
+	if err = as.Handoff(cmd); err != nil {
+		t.Fatalf("handoff failed: %v", err)
+	}
+	ctx, cf := context.WithTimeout(context.Background(), time.Second)
+	defer cf()
+	if err = as.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown should have been clean, but got %v", err)
+	}
+	ac, err := TCPClient(&ClientConfig{Addr: c.Sockname, Timeout: 5000})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	resp, err := ac.Dispatch([]byte("who"))
+	if err != nil || string(resp) != "child" {
+		t.Errorf("expected 'child' but got '%s' / %v", string(resp), err)
+	}
+	ac.Quit()
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("child process failed: %v", err)
+	}
+}
+
+func TestServHandoffMultiListener(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50749", Msglvl: Fatal}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	l, err := net.Listen("unix", "/tmp/test36.sock")
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	if err = as.AddListener("local", l); err != nil {
+		t.Fatalf("AddListener failed: %v", err)
+	}
+	// only the first listener could be passed along, so neither
+	// should be
+	if f, err := as.ListenerFile(); err == nil {
+		f.Close()
+		t.Errorf("ListenerFile should have failed with two listeners")
+	}
+	if err = as.Handoff(&exec.Cmd{}); err == nil {
+		t.Errorf("Handoff should have failed with two listeners")
+	}
+	as.Quit()
+}
@@ -0,0 +1,112 @@
+package petrel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServInterceptors(t *testing.T) {
+	var m sync.Mutex
+	trace := []string{}
+	var lat time.Duration
+	// server-wide: record the call and time it
+	timer := func(ctx context.Context, ri *ReqInfo, args [][]byte, next ContextResponder) ([]byte, error) {
+		m.Lock()
+		trace = append(trace, "timer:"+ri.Cmd)
+		m.Unlock()
+		start := time.Now()
+		resp, err := next(ctx, ri, args)
+		m.Lock()
+		lat = time.Since(start)
+		m.Unlock()
+		return resp, err
+	}
+	// per-command: refuse some requests
+	auth := func(ctx context.Context, ri *ReqInfo, args [][]byte, next ContextResponder) ([]byte, error) {
+		m.Lock()
+		trace = append(trace, "auth")
+		m.Unlock()
+		if len(args) > 0 && string(args[0]) == "mallory" {
+			return nil, &AppErr{Code: 1401, Txt: "unauthorized"}
+		}
+		return next(ctx, ri, args)
+	}
+	// per-command: modify the response
+	shout := func(ctx context.Context, ri *ReqInfo, args [][]byte, next ContextResponder) ([]byte, error) {
+		resp, err := next(ctx, ri, args)
+		return bytes.ToUpper(resp), err
+	}
+	c := &ServerConfig{Sockname: "/tmp/test25.sock", Msglvl: Fatal, Interceptors: []Interceptor{timer}}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "argv", echo)
+	as.Register("secret", "argv", napper, auth, shout)
+	as.Register("loud", "argv", echo, shout)
+
+	// client-side: count calls and rewrite the request
+	calls := 0
+	counter := func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error) {
+		calls++
+		return next(req)
+	}
+	rewrite := func(req []byte, next func([]byte) ([]byte, error)) ([]byte, error) {
+		if bytes.HasPrefix(req, []byte("nap")) {
+			req = append([]byte("secret"), req[3:]...)
+		}
+		return next(req)
+	}
+	ac, err := UnixClient(&ClientConfig{Addr: as.s, Interceptors: []ClientInterceptor{counter, rewrite}})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+
+	resp, err := ac.Dispatch([]byte("echo hello"))
+	if err != nil || string(resp) != "hello" {
+		t.Errorf("expected 'hello' but got '%s' / %v", string(resp), err)
+	}
+	// napper sleeps for 20ms and returns its arg, which shout
+	// can't change
+	resp, err = ac.Dispatch([]byte("nap 20"))
+	if err != nil || string(resp) != "20" {
+		t.Errorf("expected '20' but got '%s' / %v", string(resp), err)
+	}
+	m.Lock()
+	if lat < 20*time.Millisecond {
+		t.Errorf("interceptor should have seen at least 20ms latency but saw %v", lat)
+	}
+	m.Unlock()
+	// auth rejects this one before napper (or shout) sees it
+	var ae *AppErr
+	_, err = ac.Dispatch([]byte("secret mallory"))
+	if !errors.As(err, &ae) || ae.Code != 1401 {
+		t.Errorf("expected unauthorized error but got %v", err)
+	}
+	resp, err = ac.Dispatch([]byte("loud hello"))
+	if err != nil || string(resp) != "HELLO" {
+		t.Errorf("expected 'HELLO' but got '%s' / %v", string(resp), err)
+	}
+	if calls != 4 {
+		t.Errorf("client interceptor should have seen 4 calls but saw %d", calls)
+	}
+	m.Lock()
+	x := []string{"timer:echo", "timer:secret", "auth", "timer:secret", "auth", "timer:loud"}
+	if len(trace) != len(x) {
+		t.Errorf("expected trace %v but got %v", x, trace)
+	} else {
+		for i := range x {
+			if trace[i] != x[i] {
+				t.Errorf("expected trace %v but got %v", x, trace)
+				break
+			}
+		}
+	}
+	m.Unlock()
+	ac.Quit()
+	as.Quit()
+}
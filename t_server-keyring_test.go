@@ -0,0 +1,168 @@
+package petrel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// whosigned tells the client which identity the Server saw
+func whosigned(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+	return []byte(ri.Identity), nil
+}
+
+// keyring builds a Keyring from a Load-format string
+func keyring(t *testing.T, keys string) *Keyring {
+	kr := NewKeyring()
+	if err := kr.Load(strings.NewReader(keys)); err != nil {
+		t.Fatalf("couldn't load keyring: %s", err)
+	}
+	return kr
+}
+
+// whoClient dispatches "who" from a new Client using kr, returning
+// the response
+func whoClient(sn string, kr *Keyring) (string, error) {
+	ac, err := TCPClient(&ClientConfig{Addr: sn, Keyring: kr})
+	if err != nil {
+		return "", err
+	}
+	defer ac.Quit()
+	resp, err := ac.Dispatch([]byte("who"))
+	return string(resp), err
+}
+
+func TestServKeyring(t *testing.T) {
+	// keys "one", "two", "three"
+	skr := keyring(t, "# server keys\n1 b25l\n2 dHdv sign\n")
+	c := &ServerConfig{Sockname: "127.0.0.1:50732", Msglvl: Fatal, Keyring: skr}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("who", "argv", whosigned)
+
+	// either active key works, and is reported as the caller's
+	// identity
+	for _, k := range []struct{ ring, id string }{{"1 b25l", "hmac:1"}, {"2 dHdv", "hmac:2"}} {
+		resp, err := whoClient(as.s, keyring(t, k.ring))
+		if err != nil || resp != k.id {
+			t.Errorf("expected '%s' but got '%s' / %v", k.id, resp, err)
+		}
+	}
+	// an unknown key doesn't
+	_, err = whoClient(as.s, keyring(t, "3 dGhyZWU="))
+	if p, ok := err.(*Perr); !ok || p.Code != perrs["badmac"].Code {
+		t.Errorf("expected badmac, but got %#v", err)
+	}
+	// nor does a known ID with the wrong key
+	_, err = whoClient(as.s, keyring(t, "1 dHdv"))
+	if p, ok := err.(*Perr); !ok || p.Code != perrs["badmac"].Code {
+		t.Errorf("expected badmac, but got %#v", err)
+	}
+
+	// roll key 1 over. it is still accepted, but responses are
+	// signed with key 2, so clients need that to verify them
+	if err = skr.SetVerifyOnly(1, true); err != nil {
+		t.Errorf("couldn't make key 1 verify-only: %s", err)
+	}
+	if err = skr.SetVerifyOnly(2, true); err == nil {
+		t.Errorf("signing key should not be allowed to be verify-only")
+	}
+	resp, err := whoClient(as.s, keyring(t, "1 b25l\n2 dHdv verify"))
+	if err != nil || resp != "hmac:1" {
+		t.Errorf("expected 'hmac:1' but got '%s' / %v", resp, err)
+	}
+	_, err = whoClient(as.s, keyring(t, "1 b25l"))
+	if p, ok := err.(*Perr); !ok || p.Code != perrs["badmac"].Code {
+		t.Errorf("expected badmac, but got %#v", err)
+	}
+
+	// reload the server's keyring without key 1, and with a new
+	// key 3
+	if err = skr.Load(strings.NewReader("2 dHdv\n3 dGhyZWU=\n")); err != nil {
+		t.Fatalf("couldn't reload keyring: %s", err)
+	}
+	_, err = whoClient(as.s, keyring(t, "1 b25l\n2 dHdv verify"))
+	if p, ok := err.(*Perr); !ok || p.Code != perrs["badmac"].Code {
+		t.Errorf("expected badmac, but got %#v", err)
+	}
+	resp, err = whoClient(as.s, keyring(t, "3 dGhyZWU="))
+	if err != nil || resp != "hmac:3" {
+		t.Errorf("expected 'hmac:3' but got '%s' / %v", resp, err)
+	}
+
+	// a client switching keys mid-connection
+	ckr := keyring(t, "2 dHdv\n3 dGhyZWU=")
+	ac, err := TCPClient(&ClientConfig{Addr: as.s, Keyring: ckr})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer ac.Quit()
+	for _, id := range []uint32{2, 3} {
+		if err = ckr.Use(id); err != nil {
+			t.Errorf("couldn't use key %d: %s", id, err)
+		}
+		resp, err := ac.Dispatch([]byte("who"))
+		if want := fmt.Sprintf("hmac:%d", id); err != nil || string(resp) != want {
+			t.Errorf("expected '%s' but got '%s' / %v", want, string(resp), err)
+		}
+	}
+}
+
+func TestKeyringLoad(t *testing.T) {
+	kr := NewKeyring()
+	for _, bad := range []string{
+		"1",
+		"x b25l",
+		"1 !!!",
+		"1 b25l\n1 dHdv",
+		"1 b25l sign\n2 dHdv sign",
+		"1 b25l frob",
+	} {
+		if err := kr.Load(strings.NewReader(bad)); err == nil {
+			t.Errorf("keyring '%s' should not have loaded", bad)
+		}
+	}
+	// verify-only keys are never signing keys
+	kr = keyring(t, "1 b25l verify\n2 dHdv")
+	if id, _, err := kr.signer(0, false); err != nil || id != 2 {
+		t.Errorf("signing key should be 2, but got %d / %v", id, err)
+	}
+	if err := kr.Use(1); err == nil {
+		t.Errorf("verify-only key should not be usable")
+	}
+	kr.Remove(2)
+	if _, _, err := kr.signer(0, false); err == nil {
+		t.Errorf("keyring should have no signing key")
+	}
+	if err := kr.Add(3, []byte("three"), false); err != nil {
+		t.Errorf("couldn't add key: %s", err)
+	}
+	if id, _, err := kr.signer(1, true); err != nil || id != 3 {
+		t.Errorf("signing key should be 3, but got %d / %v", id, err)
+	}
+}
+
+func TestServKeyringIdentityRate(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50733", Msglvl: Fatal, Keyring: keyring(t, "1 b25l\n2 dHdv"),
+		IdentityRate: &RateLimit{Rate: 0.001, Burst: 1}}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("who", "argv", whosigned)
+	// each key gets one request, across connections
+	for _, ring := range []string{"1 b25l", "2 dHdv"} {
+		if _, err := whoClient(as.s, keyring(t, ring)); err != nil {
+			t.Errorf("first request should succeed, but got %v", err)
+		}
+		_, err := whoClient(as.s, keyring(t, ring))
+		if _, ok := err.(*RateLimitErr); !ok {
+			t.Errorf("expected rate limit, but got %#v", err)
+		}
+	}
+}
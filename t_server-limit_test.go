@@ -0,0 +1,133 @@
+package petrel
+
+import (
+	"testing"
+	"time"
+)
+
+// napAsync sends a request from a new Client and returns a channel
+// which gets its error
+func napAsync(t *testing.T, addr, req string) chan error {
+	ec := make(chan error, 1)
+	ac, err := TCPClient(&ClientConfig{Addr: addr})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	go func() {
+		_, err := ac.Dispatch([]byte(req))
+		ac.Quit()
+		ec <- err
+	}()
+	return ec
+}
+
+func TestServMaxDispatch(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50716", Msglvl: Fatal, MaxDispatch: 1, MaxQueue: 1}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("nap", "argv", napper)
+	// one request runs, one waits...
+	ec1 := napAsync(t, as.s, "nap 100")
+	time.Sleep(20 * time.Millisecond)
+	ec2 := napAsync(t, as.s, "nap 10")
+	time.Sleep(20 * time.Millisecond)
+	// ...and one is refused
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	_, err = ac.Dispatch([]byte("nap 10"))
+	if p, ok := err.(*Perr); !ok || p.Code != 503 || p.Kind != "busy" {
+		t.Errorf("expected busy error, but got %#v", err)
+	}
+	if err = <-ec1; err != nil {
+		t.Errorf("first request failed: %v", err)
+	}
+	if err = <-ec2; err != nil {
+		t.Errorf("queued request failed: %v", err)
+	}
+	// things are quiet again
+	resp, err := ac.Dispatch([]byte("nap 10"))
+	if err != nil || string(resp) != "10" {
+		t.Errorf("expected '10' but got '%s' / %v", string(resp), err)
+	}
+	ac.Quit()
+	as.Quit()
+}
+
+func TestServLimit(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50717", Msglvl: Error}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("nap", "argv", napper, Limit(1, 0))
+	as.Register("echo", "argv", echo)
+	ec := napAsync(t, as.s, "nap 100")
+	time.Sleep(20 * time.Millisecond)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	// nap is at its limit
+	_, err = ac.Dispatch([]byte("nap 10"))
+	if p, ok := err.(*Perr); !ok || p.Code != 503 {
+		t.Errorf("expected busy error, but got %#v", err)
+	}
+	msg := <-as.Msgr
+	if msg.Code != 503 || msg.Txt != "server busy: [nap]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	// but other commands are not
+	resp, err := ac.Dispatch([]byte("echo hi"))
+	if err != nil || string(resp) != "hi" {
+		t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+	}
+	if err = <-ec; err != nil {
+		t.Errorf("first request failed: %v", err)
+	}
+	ac.Quit()
+	as.Quit()
+}
+
+func TestServLimitDeadline(t *testing.T) {
+	for _, c := range []*ServerConfig{
+		{Sockname: "127.0.0.1:50743", Msglvl: Fatal, ReqTimeout: 20, MaxDispatch: 1},
+		{Sockname: "127.0.0.1:50744", Msglvl: Fatal, ReqTimeout: 20},
+	} {
+		as, err := TCPServer(c)
+		if err != nil {
+			t.Fatalf("Couldn't create socket: %v", err)
+		}
+		// the server-wide limit, or the Limit Interceptor
+		if c.MaxDispatch > 0 {
+			as.Register("nap", "argv", napper)
+		} else {
+			as.Register("nap", "argv", napper, Limit(1, 0))
+		}
+		ac, err := TCPClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		_, err = ac.Dispatch([]byte("nap 150"))
+		if p, ok := err.(*Perr); !ok || p.Code != 504 {
+			t.Errorf("expected timeout, but got %#v", err)
+		}
+		// the timed out request is still running, so it still
+		// has the slot
+		_, err = ac.Dispatch([]byte("nap 1"))
+		if p, ok := err.(*Perr); !ok || p.Code != 503 {
+			t.Errorf("expected busy error, but got %#v", err)
+		}
+		// until it finishes
+		time.Sleep(200 * time.Millisecond)
+		resp, err := ac.Dispatch([]byte("nap 1"))
+		if err != nil || string(resp) != "1" {
+			t.Errorf("expected '1' but got '%s' / %v", string(resp), err)
+		}
+		ac.Quit()
+		as.Quit()
+	}
+}
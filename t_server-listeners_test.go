@@ -0,0 +1,73 @@
+package petrel
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// listenername tells the client which listener it connected to
+func listenername(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+	return []byte(ri.Listener), nil
+}
+
+func TestServMultiListener(t *testing.T) {
+	c := &ServerConfig{Sockname: "/tmp/test30.sock", Msglvl: Conn}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("where", "argv", listenername)
+	l, err := net.Listen("tcp", "127.0.0.1:50731")
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	if err = as.AddListener("remote", l); err != nil {
+		t.Errorf("AddListener failed: %v", err)
+	}
+	if err = as.AddListener("remote", l); err == nil {
+		t.Errorf("AddListener with a duplicate name should have failed")
+	}
+
+	uc, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	msg := <-as.Msgr
+	if msg.Code != 100 || msg.Listener != "/tmp/test30.sock" {
+		t.Errorf("unexpected Msg: %#v", msg)
+	}
+	cn := msg.Conn
+	tc, err := TCPClient(&ClientConfig{Addr: "127.0.0.1:50731"})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	msg = <-as.Msgr
+	if msg.Code != 100 || msg.Listener != "remote" {
+		t.Errorf("unexpected Msg: %#v", msg)
+	}
+	// connection ids are unique across listeners
+	if msg.Conn == cn {
+		t.Errorf("both connections have id %d", cn)
+	}
+	// both share the same Responders
+	for ac, ln := range map[*Client]string{uc: "/tmp/test30.sock", tc: "remote"} {
+		resp, err := ac.Dispatch([]byte("where"))
+		if err != nil || string(resp) != ln {
+			t.Errorf("expected '%s' but got '%s' / %v", ln, string(resp), err)
+		}
+		ac.Quit()
+		msg = <-as.Msgr
+		if msg.Code != 198 || msg.Listener != ln {
+			t.Errorf("unexpected Msg: %#v", msg)
+		}
+	}
+	as.Quit()
+	if err = as.AddListener("late", l); err == nil {
+		t.Errorf("AddListener after Quit should have failed")
+	}
+	// and Quit closed the added listener
+	if _, err = net.Dial("tcp", "127.0.0.1:50731"); err == nil {
+		t.Errorf("added listener should have been closed")
+	}
+}
@@ -0,0 +1,61 @@
+package petrel
+
+import (
+	"strings"
+	"testing"
+)
+
+// kaboom panics, as the name suggests
+func kaboom(args [][]byte) ([]byte, error) {
+	var m map[string]int
+	m["boom"]++
+	return nil, nil
+}
+
+func TestServResponderPanic(t *testing.T) {
+	for _, pc := range []bool{false, true} {
+		c := &ServerConfig{Sockname: "/tmp/test24.sock", Msglvl: Error, PanicClose: pc}
+		as, err := UnixServer(c, 700)
+		if err != nil {
+			t.Fatalf("Couldn't create socket: %v", err)
+		}
+		as.Register("echo", "argv", echo)
+		as.Register("kaboom", "argv", kaboom)
+		ac, err := UnixClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		_, err = ac.Dispatch([]byte("kaboom"))
+		if p, ok := err.(*Perr); !ok || p.Code != 505 || p.Kind != "reqpanic" || p.Msg != "" {
+			t.Errorf("unexpected error: %#v", err)
+		}
+		msg := <-as.Msgr
+		if msg.Code != 505 || msg.Txt != "responder panicked: [kaboom]" {
+			t.Errorf("unexpected Msg: %v", msg)
+		}
+		if msg.Err == nil || !strings.HasPrefix(msg.Err.Error(), "panic: assignment to entry in nil map") ||
+			!strings.Contains(msg.Err.Error(), "goroutine") {
+			t.Errorf("Msg should carry the panic and a stack trace, but got %v", msg.Err)
+		}
+		// the Server is still up, and the connection is still
+		// up unless we asked for it to be closed
+		resp, err := ac.Dispatch([]byte("echo still here"))
+		if pc && err == nil {
+			t.Errorf("connection should have been closed, but got '%s'", string(resp))
+		}
+		if !pc && (err != nil || string(resp) != "still here") {
+			t.Errorf("expected 'still here' but got '%s' / %v", string(resp), err)
+		}
+		ac.Quit()
+		ac, err = UnixClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		resp, err = ac.Dispatch([]byte("echo still here"))
+		if err != nil || string(resp) != "still here" {
+			t.Errorf("expected 'still here' but got '%s' / %v", string(resp), err)
+		}
+		ac.Quit()
+		as.Quit()
+	}
+}
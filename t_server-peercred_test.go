@@ -0,0 +1,68 @@
+package petrel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// whoareyou tells the client what the Server knows about it
+func whoareyou(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+	if ri.Peer == nil {
+		return []byte("nobody"), nil
+	}
+	return []byte(ri.Peer.String()), nil
+}
+
+func TestServPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	me := &PeerCred{PID: int32(os.Getpid()), UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}
+	c := &ServerConfig{Sockname: "/tmp/test33.sock", Msglvl: Conn, PeerUIDs: []uint32{me.UID}}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("who", "argv", whoareyou)
+	ac, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	msg := <-as.Msgr
+	if msg.Code != 100 || msg.Txt != fmt.Sprintf("client connected: [%s]", me) {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	resp, err := ac.Dispatch([]byte("who"))
+	if err != nil || string(resp) != me.String() {
+		t.Errorf("expected '%s' but got '%s' / %v", me, string(resp), err)
+	}
+	ac.Quit()
+	<-as.Msgr // disconnect
+	as.Quit()
+
+	// now try with an allowlist we're not on
+	c = &ServerConfig{Sockname: "/tmp/test33.sock", Msglvl: Conn, PeerUIDs: []uint32{me.UID + 1}, PeerGIDs: []uint32{me.GID + 1}}
+	as, err = UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("who", "argv", whoareyou)
+	ac, err = UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	_, err = ac.Dispatch([]byte("who"))
+	if p, ok := err.(*Perr); !ok || p.Code != 405 || p.Kind != "badpeer" {
+		t.Errorf("expected peer rejection, but got %#v", err)
+	}
+	msg = <-as.Msgr
+	if msg.Code != 405 || !strings.HasPrefix(msg.Txt, "peer credentials rejected: [peer not allowed: pid=") {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	ac.Quit()
+	as.Quit()
+}
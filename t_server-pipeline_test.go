@@ -0,0 +1,87 @@
+package petrel
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// napper sleeps for the given number of milliseconds, then echoes it
+func napper(args [][]byte) ([]byte, error) {
+	n, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(time.Duration(n) * time.Millisecond)
+	return args[0], nil
+}
+
+func TestServPipeline(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50712", Msglvl: Fatal, Inflight: 4}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("nap", "argv", napper)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+
+	// send three requests without waiting; they should come back
+	// shortest-nap first, each matched to its own Call
+	start := time.Now()
+	calls := []*Call{
+		ac.Go([]byte("nap 150")),
+		ac.Go([]byte("nap 10")),
+		ac.Go([]byte("nap 80")),
+	}
+	done := make(chan *Call, 3)
+	for _, call := range calls {
+		go func(call *Call) { done <- <-call.Done }(call)
+	}
+	for i, x := range []string{"10", "80", "150"} {
+		call := <-done
+		if call.Err != nil {
+			t.Errorf("call %d returned error: %v", i, call.Err)
+		}
+		if string(call.Resp) != x {
+			t.Errorf("call %d: expected '%s' but got '%s'", i, x, string(call.Resp))
+		}
+	}
+	if calls[1].Seq != 2 || string(calls[1].Resp) != "10" {
+		t.Errorf("call with seq %d got wrong response '%s'", calls[1].Seq, string(calls[1].Resp))
+	}
+	if el := time.Since(start); el > 200*time.Millisecond {
+		t.Errorf("requests don't seem to have been handled concurrently: %v", el)
+	}
+	ac.Quit()
+	as.Quit()
+}
+
+func TestServPipelineSerial(t *testing.T) {
+	// with the default Inflight, requests are handled in order
+	c := &ServerConfig{Sockname: "127.0.0.1:50712", Msglvl: Fatal}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("nap", "argv", napper)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	c1 := ac.Go([]byte("nap 50"))
+	c2 := ac.Go([]byte("nap 1"))
+	select {
+	case <-c2.Done:
+		t.Errorf("second request finished before the first")
+	case <-c1.Done:
+	}
+	<-c2.Done
+	if string(c1.Resp) != "50" || string(c2.Resp) != "1" {
+		t.Errorf("responses mismatched: '%s' '%s'", string(c1.Resp), string(c2.Resp))
+	}
+	ac.Quit()
+	as.Quit()
+}
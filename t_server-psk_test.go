@@ -0,0 +1,169 @@
+package petrel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServPSK(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	c := &ServerConfig{Sockname: "127.0.0.1:50736", Msglvl: Fatal, PSK: psk, Inflight: 4, Timeout: 1000}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("echo", "argv", echo)
+
+	// lots of pipelined requests, so that responses are sealed
+	// concurrently
+	ac, err := TCPClient(&ClientConfig{Addr: as.s, PSK: psk})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprintf("hi %d", i)
+			resp, err := ac.Dispatch([]byte("echo " + want))
+			if err != nil || string(resp) != want {
+				t.Errorf("expected '%s' but got '%s' / %v", want, string(resp), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, err = ac.DispatchRaw([]byte("12345678")); err == nil {
+		t.Errorf("DispatchRaw should not work with a PSK")
+	}
+	ac.Quit()
+
+	// the wrong PSK fails the handshake
+	_, err = TCPClient(&ClientConfig{Addr: as.s, PSK: []byte("wrong")})
+	if err != errBadPSK {
+		t.Errorf("expected errBadPSK, but got %v", err)
+	}
+	// and no PSK gets nowhere at all
+	ac, err = TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	if _, err = ac.Dispatch([]byte("echo it works!")); err == nil {
+		t.Errorf("unencrypted request should have failed")
+	}
+	ac.Quit()
+}
+
+func TestServPSKRefused(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	c := &ServerConfig{Sockname: "127.0.0.1:50737", Msglvl: Fatal, PSK: psk, MaxConns: 1}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("echo", "argv", echo)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s, PSK: psk})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer ac.Quit()
+	// the refusal notice is encrypted like anything else
+	bc, err := TCPClient(&ClientConfig{Addr: as.s, PSK: psk})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	defer bc.Quit()
+	_, err = bc.Dispatch([]byte("echo hi"))
+	if p, ok := err.(*Perr); !ok || p.Code != 403 {
+		t.Errorf("expected refusal, but got %#v", err)
+	}
+}
+
+func TestServPSKStalled(t *testing.T) {
+	psk := []byte("0123456789abcdef0123456789abcdef")
+	c := &ServerConfig{Sockname: "127.0.0.1:50739", Msglvl: Fatal, PSK: psk}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	// a client which never sends its hello doesn't hold up
+	// Shutdown
+	conn, err := net.Dial("tcp", as.s)
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cf := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cf()
+	if err = as.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, but got %v", err)
+	}
+
+	// and with no Timeout, the handshake still has a deadline, so
+	// it doesn't hold up Quit forever either
+	ht := handshakeTime
+	handshakeTime = 50 * time.Millisecond
+	defer func() { handshakeTime = ht }()
+	c.Sockname = "127.0.0.1:50740"
+	as, err = TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	conn, err = net.Dial("tcp", as.s)
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	done := make(chan bool)
+	go func() {
+		as.Quit()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Quit is stuck on an unfinished handshake")
+	}
+}
+
+func TestAEADSealer(t *testing.T) {
+	confirm, c2s, s2c := pskKeys([]byte("psk"), []byte("client random"), []byte("server random"))
+	if bytes.Equal(c2s, s2c) || bytes.Equal(confirm, c2s) {
+		t.Errorf("derived keys should all differ")
+	}
+	cs, _ := newAEADSealer(c2s, s2c)
+	ss, _ := newAEADSealer(s2c, c2s)
+	for i := 0; i < 3; i++ {
+		xmission, _, err := marshalXmission([]byte("secret stuff"), cs, uint32(i))
+		if err != nil {
+			t.Fatalf("couldn't seal: %s", err)
+		}
+		if bytes.Contains(xmission, []byte("secret")) || len(xmission) != 9+16+12 {
+			t.Errorf("bad transmission: %v", xmission)
+		}
+		// the same transmission can't be opened twice, since
+		// the nonce has moved on
+		for j, want := range []string{"", "badmac"} {
+			resp, _, perr := ss.open(xmission[:25], xmission[25:])
+			if perr != want || (j == 0 && string(resp) != "secret stuff") {
+				t.Errorf("open %d: expected '%s' but got '%s' / '%s'", j, want, resp, perr)
+			}
+		}
+		ss.rn--
+	}
+	// and tampering is detected
+	xmission, _, _ := marshalXmission([]byte("secret stuff"), cs, 7)
+	xmission[0]++
+	if _, _, perr := ss.open(xmission[:25], xmission[25:]); perr != "badmac" {
+		t.Errorf("tampered header should be refused, but got '%s'", perr)
+	}
+}
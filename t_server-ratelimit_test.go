@@ -0,0 +1,122 @@
+package petrel
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+// checkRateLimited checks that a request is refused with a sensible
+// retry-after hint
+func checkRateLimited(t *testing.T, ac *Client) {
+	_, err := ac.Dispatch([]byte("echo hi"))
+	if rl, ok := err.(*RateLimitErr); !ok || rl.RetryAfter <= 0 || rl.RetryAfter > time.Second {
+		t.Errorf("expected rate limit error, but got %#v", err)
+	}
+}
+
+func TestServConnRate(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50721", Msglvl: Error, ConnRate: &RateLimit{Rate: 1, Burst: 2}}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "argv", echo)
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if resp, err := ac.Dispatch([]byte("echo hi")); err != nil || string(resp) != "hi" {
+			t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+		}
+	}
+	checkRateLimited(t, ac)
+	msg := <-as.Msgr
+	if msg.Code != 429 || msg.Txt != "rate limited: [connection]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	// the limit is per connection, so a new one is fine
+	ac2, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	if resp, err := ac2.Dispatch([]byte("echo hi")); err != nil || string(resp) != "hi" {
+		t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+	}
+	ac2.Quit()
+	ac.Quit()
+	as.Quit()
+}
+
+func TestServIPRate(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50722", Msglvl: Error, IPRate: &RateLimit{Rate: 1, Burst: 2}}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "argv", echo)
+	acs := []*Client{}
+	for i := 0; i < 2; i++ {
+		ac, err := TCPClient(&ClientConfig{Addr: as.s})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		if resp, err := ac.Dispatch([]byte("echo hi")); err != nil || string(resp) != "hi" {
+			t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+		}
+		acs = append(acs, ac)
+	}
+	checkRateLimited(t, acs[0])
+	msg := <-as.Msgr
+	if msg.Code != 429 || msg.Txt != "rate limited: [address]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	for _, ac := range acs {
+		ac.Quit()
+	}
+	as.Quit()
+}
+
+func TestServIdentityRate(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50723", Msglvl: Error, IdentityRate: &RateLimit{Rate: 1, Burst: 2}}
+	stc := servertc.Clone()
+	stc.ClientAuth = tls.RequireAnyClientCert
+	as, err := TLSServer(c, stc)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("echo", "argv", echo)
+	ctc := clienttc.Clone()
+	ctc.Certificates = servertc.Certificates
+	acs := []*Client{}
+	for i := 0; i < 2; i++ {
+		ac, err := TLSClient(&ClientConfig{Addr: as.s}, ctc)
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		if resp, err := ac.Dispatch([]byte("echo hi")); err != nil || string(resp) != "hi" {
+			t.Errorf("expected 'hi' but got '%s' / %v", string(resp), err)
+		}
+		acs = append(acs, ac)
+	}
+	// both connections present the same certificate, and so
+	// share a limit
+	checkRateLimited(t, acs[1])
+	msg := <-as.Msgr
+	if msg.Code != 429 || msg.Txt != "rate limited: [identity]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	for _, ac := range acs {
+		ac.Quit()
+	}
+	as.Quit()
+}
+
+func TestRetryAfter(t *testing.T) {
+	for msg, d := range map[string]time.Duration{"1500": 1500 * time.Millisecond, "0": 0, "soon": 0} {
+		if retryAfter(msg) != d {
+			t.Errorf("retryAfter(%s) should be %v, but got %v", msg, d, retryAfter(msg))
+		}
+	}
+}
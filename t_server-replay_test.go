@@ -0,0 +1,126 @@
+package petrel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServReplay(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50734", Msglvl: Fatal, HMACKey: []byte("test"), ReplayWindow: 2000}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("echo", "argv", echo)
+
+	// a replay-protected client works normally
+	cc := &ClientConfig{Addr: as.s, HMACKey: []byte("test"), ReplayWindow: 2000}
+	ac, err := TCPClient(cc)
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := ac.Dispatch([]byte("echo it works!"))
+		if err != nil || string(resp) != "it works!" {
+			t.Errorf("expected 'it works!' but got '%s' / %v", string(resp), err)
+		}
+	}
+	ac.Quit()
+	// one which isn't can't talk to the server
+	ac, err = TCPClient(&ClientConfig{Addr: as.s, HMACKey: []byte("test")})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	if _, err = ac.Dispatch([]byte("echo it works!")); err == nil {
+		t.Errorf("unprotected request should have failed")
+	}
+	ac.Quit()
+
+	// now capture a request and send it twice
+	sl := cc.sealer()
+	xmission, _, err := marshalXmission([]byte("echo again"), sl, 1)
+	if err != nil {
+		t.Fatalf("couldn't marshal request: %s", err)
+	}
+	conn, err := net.Dial("tcp", as.s)
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+	defer conn.Close()
+	var seq uint32
+	for i := 0; i < 2; i++ {
+		if _, err = conn.Write(xmission); err != nil {
+			t.Fatalf("couldn't send request: %s", err)
+		}
+	}
+	resp, perr, _, err := connRead(conn, time.Second, 0, sl, &seq, nil, nil)
+	if perr != "" || string(resp) != "again" {
+		t.Errorf("expected 'again' but got '%s' / %s %v", string(resp), perr, err)
+	}
+	resp, perr, _, err = connRead(conn, time.Second, 0, sl, &seq, nil, nil)
+	if p := unframe(resp); perr != "" || p == nil || p.Code != 406 || p.Kind != "replay" {
+		t.Errorf("expected replay error, but got '%s' / %s %v", string(resp), perr, err)
+	}
+	// and the server hangs up
+	if _, perr, _, _ = connRead(conn, time.Second, 0, sl, &seq, nil, nil); perr != "disconnect" {
+		t.Errorf("expected disconnect, but got %s", perr)
+	}
+
+	// replaying on another connection doesn't work either
+	conn, err = net.Dial("tcp", as.s)
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+	defer conn.Close()
+	conn.Write(xmission)
+	resp, perr, _, err = connRead(conn, time.Second, 0, sl, &seq, nil, nil)
+	if p := unframe(resp); perr != "" || p == nil || p.Code != 406 {
+		t.Errorf("expected replay error, but got '%s' / %s %v", string(resp), perr, err)
+	}
+
+	// tampering with the header breaks the MAC
+	xmission, _, _ = marshalXmission([]byte("echo again"), sl, 1)
+	xmission[0] = 2
+	conn, err = net.Dial("tcp", as.s)
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+	defer conn.Close()
+	conn.Write(xmission)
+	resp, perr, _, err = connRead(conn, time.Second, 0, sl, &seq, nil, nil)
+	if p := unframe(resp); perr != "" || p == nil || p.Code != 502 {
+		t.Errorf("expected badmac error, but got '%s' / %s %v", string(resp), perr, err)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	nc := newNonceCache(1000)
+	now := time.Now()
+	for _, x := range []struct {
+		ts    time.Time
+		nonce string
+		ok    bool
+	}{
+		{now, "a", true},
+		{now, "a", false},
+		{now.Add(-500 * time.Millisecond), "b", true},
+		{now.Add(500 * time.Millisecond), "c", true},
+		{now.Add(-2 * time.Second), "d", false},
+		{now.Add(2 * time.Second), "e", false},
+	} {
+		if nc.fresh(x.ts.UnixNano(), []byte(x.nonce)) != x.ok {
+			t.Errorf("nonce %s at %v should have been %v", x.nonce, x.ts, x.ok)
+		}
+	}
+	// expired nonces are swept
+	nc.sw = now.Add(-2 * time.Second)
+	for k := range nc.seen {
+		nc.seen[k] = now.Add(-time.Second).UnixNano()
+	}
+	nc.fresh(now.UnixNano(), []byte("f"))
+	if len(nc.seen) != 1 {
+		t.Errorf("expected 1 nonce after sweep, but have %d", len(nc.seen))
+	}
+}
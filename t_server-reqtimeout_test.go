@@ -0,0 +1,113 @@
+package petrel
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServReqTimeout(t *testing.T) {
+	c := &ServerConfig{Sockname: "/tmp/test27.sock", Msglvl: Error, ReqTimeout: 20}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	// cancelled is closed when the ContextResponder sees its
+	// deadline pass
+	cancelled := make(chan bool)
+	as.Register("nap", "argv", napper)
+	as.Register("longnap", "argv", napper, Deadline(200))
+	as.Register("ctxnap", "argv", func(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+	ac, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+
+	// quick requests are unaffected
+	resp, err := ac.Dispatch([]byte("nap 1"))
+	if err != nil || string(resp) != "1" {
+		t.Errorf("expected '1' but got '%s' / %v", string(resp), err)
+	}
+	// slow ones get the server default deadline
+	_, err = ac.Dispatch([]byte("nap 100"))
+	if p, ok := err.(*Perr); !ok || p.Code != 504 || p.Kind != "reqtimeout" {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	msg := <-as.Msgr
+	if msg.Code != 504 || !strings.HasPrefix(msg.Txt, "request timed out: [nap after ") {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	// unless they have their own
+	resp, err = ac.Dispatch([]byte("longnap 100"))
+	if err != nil || string(resp) != "100" {
+		t.Errorf("expected '100' but got '%s' / %v", string(resp), err)
+	}
+	// and ContextResponders see the cancellation
+	_, err = ac.Dispatch([]byte("ctxnap"))
+	if p, ok := err.(*Perr); !ok || p.Code != 504 {
+		t.Errorf("unexpected error: %#v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("ContextResponder's Context was not cancelled")
+	}
+	msg = <-as.Msgr
+	if msg.Code != 504 || !strings.HasPrefix(msg.Txt, "request timed out: [ctxnap after ") {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	ac.Quit()
+	as.Quit()
+}
+
+func TestServReqTimeoutBackground(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50746", Msglvl: Error, ReqTimeout: 20}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	var finished int32
+	as.Register("slow", "argv", func(args [][]byte) ([]byte, error) {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		return nil, nil
+	})
+	as.Register("boom", "argv", func(args [][]byte) ([]byte, error) {
+		time.Sleep(50 * time.Millisecond)
+		panic("too late")
+	})
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	// a Responder which panics after its deadline is still
+	// reported
+	if _, err = ac.Dispatch([]byte("boom")); err == nil {
+		t.Errorf("boom should have timed out")
+	}
+	<-as.Msgr // timeout
+	msg := <-as.Msgr
+	if msg.Code != 505 || msg.Txt != "responder panicked: [boom after deadline]" {
+		t.Errorf("unexpected Msg: %v", msg)
+	}
+	// and Quit waits for Responders which are running late
+	if _, err = ac.Dispatch([]byte("slow")); err == nil {
+		t.Errorf("slow should have timed out")
+	}
+	<-as.Msgr // timeout
+	ac.Quit()
+	go func() {
+		for range as.Msgr {
+		}
+	}()
+	as.Quit()
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Errorf("Quit returned while a Responder was still running")
+	}
+}
@@ -0,0 +1,111 @@
+package petrel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestServShutdown(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50724", Msglvl: Fatal, Inflight: 2}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("nap", "argv", napper)
+	// one idle client and one busy one
+	idle, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	busy, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	call := busy.Go([]byte("nap 100"))
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cf := context.WithTimeout(context.Background(), time.Second)
+	defer cf()
+	start := time.Now()
+	if err = as.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown should have been clean, but got %v", err)
+	}
+	if el := time.Since(start); el > 500*time.Millisecond {
+		t.Errorf("Shutdown took %v", el)
+	}
+	// the in-flight request finished
+	<-call.Done
+	if call.Err != nil || string(call.Resp) != "100" {
+		t.Errorf("expected '100' but got '%s' / %v", string(call.Resp), call.Err)
+	}
+	// and both clients were told goodbye
+	for _, ac := range []*Client{idle, busy} {
+		if !ac.closed() {
+			t.Errorf("client should have been closed")
+		}
+		_, err = ac.Dispatch([]byte("nap 1"))
+		if err == nil {
+			t.Errorf("request after shutdown should have failed")
+		}
+		ac.Quit()
+	}
+}
+
+func TestServShutdownForce(t *testing.T) {
+	c := &ServerConfig{Sockname: "127.0.0.1:50725", Msglvl: Fatal}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	as.Register("wait", "argv", func(ctx context.Context, ri *ReqInfo, args [][]byte) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ac, err := TCPClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	call := ac.Go([]byte("wait"))
+	time.Sleep(20 * time.Millisecond)
+	ctx, cf := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cf()
+	if err = as.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, but got %v", err)
+	}
+	<-call.Done
+	if call.Err == nil {
+		t.Errorf("request should have failed, but got '%s'", string(call.Resp))
+	}
+	ac.Quit()
+}
+
+func TestClientGoodbye(t *testing.T) {
+	c := &ServerConfig{Sockname: "/tmp/test28.sock", Msglvl: Conn}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	ac, err := UnixClient(&ClientConfig{Addr: as.s})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	// hold a request open, so we can see what it gets
+	ac.m.Lock()
+	call := &Call{Seq: ac.nextSeq(), Done: make(chan *Call, 1), conn: ac.conn}
+	ac.pend[call.Seq] = call
+	ac.m.Unlock()
+	<-as.Msgr // connect
+	go as.Shutdown(context.Background())
+	msg := <-as.Msgr
+	if msg.Code != 195 {
+		t.Errorf("expected goodbye Msg, but got %v", msg)
+	}
+	<-call.Done
+	if p, ok := call.Err.(*Perr); !ok || p.Code != 195 || p.Kind != "goodbye" {
+		t.Errorf("expected goodbye error, but got %#v", call.Err)
+	}
+	for range as.Msgr {
+	}
+	ac.Quit()
+}
@@ -0,0 +1,115 @@
+package petrel
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestServEd25519(t *testing.T) {
+	spub, spriv, _ := ed25519.GenerateKey(nil)
+	apub, apriv, _ := ed25519.GenerateKey(nil)
+	bpub, bpriv, _ := ed25519.GenerateKey(nil)
+	_, xpriv, _ := ed25519.GenerateKey(nil)
+	c := &ServerConfig{Sockname: "127.0.0.1:50735", Msglvl: Fatal, SignKey: spriv, ClientKeys: []ed25519.PublicKey{apub, bpub}}
+	as, err := TCPServer(c)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	defer as.Quit()
+	as.Register("who", "argv", whosigned)
+
+	// each authorized client is identified by its key
+	for _, k := range []struct {
+		priv ed25519.PrivateKey
+		pub  ed25519.PublicKey
+	}{{apriv, apub}, {bpriv, bpub}} {
+		ac, err := TCPClient(&ClientConfig{Addr: as.s, SignKey: k.priv, ServerKey: spub})
+		if err != nil {
+			t.Fatalf("client instantiation failed! %s", err)
+		}
+		resp, err := ac.Dispatch([]byte("who"))
+		if want := Ed25519Identity(k.pub); err != nil || string(resp) != want {
+			t.Errorf("expected '%s' but got '%s' / %v", want, string(resp), err)
+		}
+		ac.Quit()
+	}
+
+	// an unknown key is refused
+	ac, err := TCPClient(&ClientConfig{Addr: as.s, SignKey: xpriv, ServerKey: spub})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	_, err = ac.Dispatch([]byte("who"))
+	if p, ok := err.(*Perr); !ok || p.Code != perrs["badmac"].Code {
+		t.Errorf("expected badmac, but got %#v", err)
+	}
+	ac.Quit()
+
+	// and a client which doesn't trust the server's key won't
+	// accept its responses
+	ac, err = TCPClient(&ClientConfig{Addr: as.s, SignKey: apriv, ServerKey: bpub})
+	if err != nil {
+		t.Fatalf("client instantiation failed! %s", err)
+	}
+	_, err = ac.Dispatch([]byte("who"))
+	if p, ok := err.(*Perr); !ok || p.Code != perrs["badmac"].Code {
+		t.Errorf("expected badmac, but got %#v", err)
+	}
+	ac.Quit()
+
+	// tampering with a signed transmission is detected
+	sl := newSigSealer(apriv, spub)
+	xmission, _, err := marshalXmission([]byte("who"), sl, 1)
+	if err != nil {
+		t.Fatalf("couldn't marshal request: %s", err)
+	}
+	if _, _, perr := sl.open(xmission[:81], xmission[81:]); perr != "badmac" {
+		t.Errorf("our own signature shouldn't be accepted, but got '%s'", perr)
+	}
+	srv := newSigSealer(spriv, apub)
+	if resp, id, perr := srv.open(xmission[:81], xmission[81:]); perr != "" || string(resp) != "who" || id != Ed25519Identity(apub) {
+		t.Errorf("signature should be accepted, but got '%s' '%s' '%s'", resp, id, perr)
+	}
+	xmission[0]++
+	if _, _, perr := srv.open(xmission[:81], xmission[81:]); perr != "badmac" {
+		t.Errorf("tampered header should be refused, but got '%s'", perr)
+	}
+	xmission[0]--
+	xmission[81]++
+	if _, _, perr := srv.open(xmission[:81], xmission[81:]); perr != "badmac" {
+		t.Errorf("tampered payload should be refused, but got '%s'", perr)
+	}
+}
+
+func TestServEd25519BadKeys(t *testing.T) {
+	spub, spriv, _ := ed25519.GenerateKey(nil)
+	apub, apriv, _ := ed25519.GenerateKey(nil)
+	// bad keys are caught before anything is set up
+	for i, c := range []*ServerConfig{
+		{SignKey: spriv[:10], ClientKeys: []ed25519.PublicKey{apub}},
+		{SignKey: spriv},
+		{SignKey: spriv, ClientKeys: []ed25519.PublicKey{apub, apub[:10]}},
+		{ClientKeys: []ed25519.PublicKey{apub}},
+	} {
+		c.Sockname = "127.0.0.1:50738"
+		c.Msglvl = Fatal
+		if as, err := TCPServer(c); err == nil {
+			as.Quit()
+			t.Errorf("server config %d should have been rejected", i)
+		}
+	}
+	for i, c := range []*ClientConfig{
+		{SignKey: apriv[:10], ServerKey: spub},
+		{SignKey: apriv},
+		{SignKey: apriv, ServerKey: spub[:10]},
+		{ServerKey: spub},
+	} {
+		c.Addr = "127.0.0.1:50738"
+		// nothing is listening, so make sure it's the keys
+		// which are rejected
+		if _, err := TCPClient(c); err == nil || !strings.Contains(err.Error(), "Key") {
+			t.Errorf("client config %d should have been rejected, but got %v", i, err)
+		}
+	}
+}
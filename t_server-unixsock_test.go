@@ -0,0 +1,93 @@
+//go:build !windows
+// +build !windows
+
+package petrel
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestServUnixStale(t *testing.T) {
+	sn := "/tmp/test31.sock"
+	os.Remove(sn)
+	// leave a dead socket behind
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sn, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if _, err = UnixServer(&ServerConfig{Sockname: sn}, 700); err == nil {
+		t.Fatalf("UnixServer should have failed on a stale socket")
+	}
+	c := &ServerConfig{Sockname: sn, Msglvl: Fatal, UnixClean: true}
+	as, err := UnixServer(c, 700)
+	if err != nil {
+		t.Fatalf("UnixServer should have cleaned up the stale socket, but got %v", err)
+	}
+	// a live socket is left alone
+	if _, err = UnixServer(c, 700); err == nil {
+		t.Errorf("UnixServer should have failed on a live socket")
+	}
+	as.Quit()
+	if _, err = os.Stat(sn); !os.IsNotExist(err) {
+		t.Errorf("socket file should have been removed, but got %v", err)
+	}
+	// and so is anything which isn't a socket
+	f, _ := os.Create(sn)
+	f.Close()
+	if _, err = UnixServer(c, 700); err == nil {
+		t.Errorf("UnixServer should have failed on a regular file")
+	}
+	if _, err = os.Stat(sn); err != nil {
+		t.Errorf("regular file should not have been removed: %v", err)
+	}
+	os.Remove(sn)
+}
+
+func TestServUnixOwnership(t *testing.T) {
+	dir := "/tmp/petrel-test32"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	sn := dir + "/sub/test32.sock"
+	u, err := user.Current()
+	if err != nil {
+		t.Fatalf("Couldn't look up current user: %v", err)
+	}
+	c := &ServerConfig{Sockname: sn, Msglvl: Fatal, UnixDirPerm: 0750,
+		UnixOwner: u.Username, UnixGroup: strconv.Itoa(os.Getgid()), UnixKeep: true}
+	as, err := UnixServer(c, 0760)
+	if err != nil {
+		t.Fatalf("Couldn't create socket: %v", err)
+	}
+	fi, err := os.Stat(dir + "/sub")
+	if err != nil || !fi.IsDir() || fi.Mode().Perm() != 0750 {
+		t.Errorf("socket dir not created properly: %v / %v", fi, err)
+	}
+	fi, err = os.Stat(sn)
+	if err != nil || fi.Mode().Perm() != 0760 {
+		t.Errorf("socket not created properly: %v / %v", fi, err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if strconv.Itoa(int(st.Uid)) != u.Uid || int(st.Gid) != os.Getgid() {
+		t.Errorf("socket owned by %d:%d", st.Uid, st.Gid)
+	}
+	as.Quit()
+	// we asked for the socket to be kept
+	if _, err = os.Stat(sn); err != nil {
+		t.Errorf("socket file should have been kept: %v", err)
+	}
+	os.Remove(sn)
+	c.UnixOwner = "petrel-no-such-user"
+	if _, err = UnixServer(c, 0760); err == nil {
+		t.Errorf("UnixServer should have failed with a bad owner")
+	}
+	if _, err = os.Stat(sn); !os.IsNotExist(err) {
+		t.Errorf("socket file should have been removed after failure, but got %v", err)
+	}
+}